@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Queue in front of stdout for access log lines, nil when lines are written synchronously
+var accessLogQueue *asyncLogWriter
+
+// Initialize access log buffering from environment variables
+func init() {
+	// ACCESS_LOG_BUFFER is the number of lines that may wait for a slow stdout, 0 writes synchronously
+	if size := getEnvInt64("ACCESS_LOG_BUFFER", 0); size > 0 {
+		accessLogQueue = newAsyncLogWriter(os.Stdout, int(size))
+		accessLogger.SetOutput(accessLogQueue)
+	}
+}
+
+// asyncLogWriter hands log lines to a background goroutine so requests never wait for the
+// output. Lines that do not fit into the queue are dropped and counted instead of blocking.
+type asyncLogWriter struct {
+	out     io.Writer
+	lines   chan []byte
+	done    chan struct{}
+	mutex   sync.RWMutex // Guards closed against concurrent Writes
+	closed  bool
+	dropped atomic.Int64
+}
+
+// newAsyncLogWriter starts a writer with room for size queued lines
+func newAsyncLogWriter(out io.Writer, size int) *asyncLogWriter {
+	a := &asyncLogWriter{out: out, lines: make(chan []byte, size), done: make(chan struct{})}
+	go a.run()
+	return a
+}
+
+// Write queues a line, it never blocks on the output
+func (a *asyncLogWriter) Write(p []byte) (int, error) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	// Requests that outlive shutdown still get logged, just synchronously
+	if a.closed {
+		return a.out.Write(p)
+	}
+	select {
+	case a.lines <- bytes.Clone(p):
+	default:
+		a.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+// run writes queued lines, batching them while the queue is busy
+func (a *asyncLogWriter) run() {
+	defer close(a.done)
+	out := bufio.NewWriterSize(a.out, 64*1024)
+	for line := range a.lines {
+		out.Write(line)
+		// Flush once the queue is drained, so lines are never held back while idle
+		if len(a.lines) == 0 {
+			out.Flush()
+		}
+	}
+	out.Flush()
+}
+
+// Close writes out every queued line and switches to synchronous writes
+func (a *asyncLogWriter) Close() error {
+	a.mutex.Lock()
+	if a.closed {
+		a.mutex.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.lines)
+	a.mutex.Unlock()
+
+	<-a.done
+	if dropped := a.dropped.Load(); dropped > 0 {
+		log.Printf("Dropped %d access log lines because ACCESS_LOG_BUFFER was full", dropped)
+	}
+	return nil
+}
+
+// flushAccessLog writes out buffered access log lines on shutdown
+func flushAccessLog() {
+	if accessLogQueue != nil {
+		accessLogQueue.Close()
+	}
+}
+
+// writeAccessLogMetrics appends access log queue metrics in Prometheus format
+func writeAccessLogMetrics(sb *strings.Builder) {
+	if accessLogQueue == nil {
+		return
+	}
+	sb.WriteString("# HELP access_log_queue_length Access log lines waiting to be written\n")
+	sb.WriteString("# TYPE access_log_queue_length gauge\n")
+	sb.WriteString(fmt.Sprintf("access_log_queue_length %d\n", len(accessLogQueue.lines)))
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP access_log_dropped_total Access log lines dropped because the queue was full\n")
+	sb.WriteString("# TYPE access_log_dropped_total counter\n")
+	sb.WriteString(fmt.Sprintf("access_log_dropped_total %d\n", accessLogQueue.dropped.Load()))
+	sb.WriteString("\n")
+}
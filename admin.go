@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// Bearer token protecting admin endpoints. Without it they are only served by management
+	// listeners, see servesAdminWithoutToken.
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	// Setting and config keys whose values are never logged or fingerprinted as they are
+	sensitiveKeyPattern = regexp.MustCompile(`(?i)(token|secret|password|passwd|credential|authorization|cookie|api_?key|private_?key)`)
+)
+
+// AdminMiddleware restricts admin endpoints to callers presenting ADMIN_TOKEN
+func AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken != "" {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				writeError(w, r, http.StatusUnauthorized, "Admin token required")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// servesAdminWithoutToken reports whether a listener may serve admin endpoints when ADMIN_TOKEN
+// is unset: only a management listener, one that explicitly exposes the admin group and does
+// not expose the proxy. Anywhere else admin endpoints fail closed and are not registered.
+func servesAdminWithoutToken(lc listenerConfig) bool {
+	return slices.Contains(lc.Groups, "admin") && !lc.exposes("proxy")
+}
+
+// redactValue hides the value of a sensitive setting or config key and the credentials of URLs
+func redactValue(key string, value any) any {
+	if sensitiveKeyPattern.MatchString(key) {
+		return "[redacted]"
+	}
+	if text, ok := value.(string); ok {
+		if u, err := url.Parse(text); err == nil && u.User != nil {
+			return u.Redacted()
+		}
+	}
+	return value
+}
+
+// selfDiagnostics is the snapshot returned by the self-diagnostics endpoint
+type selfDiagnostics struct {
+	Build           buildInfo      `json:"build"`
+	Uptime          string         `json:"uptime"`
+	Goroutines      int            `json:"goroutines"`
+	OpenConnections int64          `json:"open_connections"`
+	Memory          memoryStats    `json:"memory"`
+	Backends        []backendState `json:"backends"`
+	ConfigHash      string         `json:"config_hash"`
+	Cache           *cacheStats    `json:"cache,omitempty"`
+}
+
+// memoryStats is the subset of runtime.MemStats useful for incident triage
+type memoryStats struct {
+	HeapAllocBytes  uint64 `json:"heap_alloc_bytes"`
+	HeapInuseBytes  uint64 `json:"heap_inuse_bytes"`
+	HeapObjects     uint64 `json:"heap_objects"`
+	SysBytes        uint64 `json:"sys_bytes"`
+	TotalAllocBytes uint64 `json:"total_alloc_bytes"`
+	NumGC           uint32 `json:"num_gc"`
+	LastGC          string `json:"last_gc,omitempty"`
+}
+
+// configHash fingerprints the settings read from the environment and the file configuration,
+// both redacted, so instances can be compared. Per-instance values such as the pod name are
+// not settings, so replicas with the same configuration get the same hash.
+func configHash() string {
+	settings.mutex.Lock()
+	lines := make([]string, 0, len(settings.values))
+	for key, value := range settings.values {
+		lines = append(lines, fmt.Sprintf("env %s=%v", key, redactValue(key, value)))
+	}
+	settings.mutex.Unlock()
+	for key, value := range flattenConfig(getConfig()) {
+		lines = append(lines, fmt.Sprintf("config %s=%v", key, redactValue(key, value)))
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, line := range lines {
+		h.Write([]byte(line))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// SelfDiagnosticsHandler reports runtime, connection, backend and configuration state as JSON
+func SelfDiagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	// Only process requests for exact "/debug/self" path
+	if r.URL.Path != "/debug/self" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	diagnostics := selfDiagnostics{
+		Build:           currentBuildInfo(),
+		Uptime:          time.Since(startTime).String(),
+		Goroutines:      runtime.NumGoroutine(),
+		OpenConnections: openConnections.Load(),
+		Memory: memoryStats{
+			HeapAllocBytes:  mem.HeapAlloc,
+			HeapInuseBytes:  mem.HeapInuse,
+			HeapObjects:     mem.HeapObjects,
+			SysBytes:        mem.Sys,
+			TotalAllocBytes: mem.TotalAlloc,
+			NumGC:           mem.NumGC,
+		},
+		Backends:   backends.snapshot(),
+		ConfigHash: configHash(),
+		Cache:      responseCache.stats(),
+	}
+	if mem.LastGC > 0 {
+		diagnostics.Memory.LastGC = time.Unix(0, int64(mem.LastGC)).UTC().Format(time.RFC3339)
+	}
+
+	writeIndentedResponse(w, r, http.StatusOK, diagnostics)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tokens are renewed this long before they expire
+const oauth2ExpiryMargin = 30 * time.Second
+
+// Payload hash S3 accepts in place of the hash of a body too large to buffer
+const sigV4UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// errSigV4BodyTooLarge marks a request body over BACKEND_SIGV4_MAX_BODY_BYTES, answered with 413
+var errSigV4BodyTooLarge = errors.New("request body exceeds BACKEND_SIGV4_MAX_BODY_BYTES")
+
+// backendAuthTransport attaches upstream credentials to every backend request
+type backendAuthTransport struct {
+	next      http.RoundTripper
+	authorize func(req *http.Request) error
+}
+
+// newBackendAuthTransport wraps a transport with the credentials selected by BACKEND_AUTH.
+// OAuth2 tokens are fetched with tokenTransport.
+func newBackendAuthTransport(next, tokenTransport http.RoundTripper) (http.RoundTripper, error) {
+	switch mode := getEnv("BACKEND_AUTH", "none"); mode {
+	case "none":
+		return next, nil
+	case "bearer":
+		token, err := readSecret("BACKEND_BEARER_TOKEN")
+		if err != nil {
+			return nil, err
+		}
+		return &backendAuthTransport{next: next, authorize: func(req *http.Request) error {
+			req.Header.Set("Authorization", "Bearer "+token)
+			return nil
+		}}, nil
+	case "oauth2":
+		source, err := newOAuth2TokenSource(tokenTransport)
+		if err != nil {
+			return nil, err
+		}
+		return &backendAuthTransport{next: next, authorize: source.authorize}, nil
+	case "sigv4":
+		signer, err := newSigV4Signer()
+		if err != nil {
+			return nil, err
+		}
+		return &backendAuthTransport{next: next, authorize: signer.sign}, nil
+	default:
+		return nil, fmt.Errorf("unsupported BACKEND_AUTH=%q, expected none, bearer, oauth2 or sigv4", mode)
+	}
+}
+
+// readSecret returns the value of an environment variable, or of the file named by its _FILE variant
+func readSecret(key string) (string, error) {
+	if path := os.Getenv(key + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%s_FILE: %w", key, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if value := os.Getenv(key); value != "" {
+		return value, nil
+	}
+	return "", fmt.Errorf("%s or %s_FILE must be set", key, key)
+}
+
+// RoundTrip sends a copy of the request carrying the backend credentials. Client supplied
+// Authorization headers are replaced so they never reach the backend.
+func (t *backendAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	outbound := req.Clone(req.Context())
+	if err := t.authorize(outbound); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("backend credentials: %w", err)
+	}
+	return t.next.RoundTrip(outbound)
+}
+
+// oauth2TokenSource fetches and caches access tokens with the client credentials grant
+type oauth2TokenSource struct {
+	client       *http.Client
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       string
+
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newOAuth2TokenSource reads the client credentials settings from environment variables
+func newOAuth2TokenSource(transport http.RoundTripper) (*oauth2TokenSource, error) {
+	secret, err := readSecret("BACKEND_OAUTH2_CLIENT_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	source := &oauth2TokenSource{
+		client:       &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		tokenURL:     lookupSetting("BACKEND_OAUTH2_TOKEN_URL"),
+		clientID:     lookupSetting("BACKEND_OAUTH2_CLIENT_ID"),
+		clientSecret: secret,
+		scopes:       lookupSetting("BACKEND_OAUTH2_SCOPES"),
+	}
+	if source.tokenURL == "" || source.clientID == "" {
+		return nil, errors.New("BACKEND_OAUTH2_TOKEN_URL and BACKEND_OAUTH2_CLIENT_ID must be set")
+	}
+	return source, nil
+}
+
+// authorize attaches a cached access token, fetching a new one when it is about to expire.
+// Concurrent requests wait for a single token request.
+func (s *oauth2TokenSource) authorize(req *http.Request) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.token == "" || time.Now().After(s.expires.Add(-oauth2ExpiryMargin)) {
+		if err := s.refresh(req); err != nil {
+			return err
+		}
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	return nil
+}
+
+// refresh requests a new access token, the caller must hold the mutex
+func (s *oauth2TokenSource) refresh(req *http.Request) error {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if s.scopes != "" {
+		form.Set("scope", s.scopes)
+	}
+	tokenReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tokenReq.Header.Set("Accept", "application/json")
+	tokenReq.SetBasicAuth(url.QueryEscape(s.clientID), url.QueryEscape(s.clientSecret))
+
+	resp, err := s.client.Do(tokenReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return fmt.Errorf("decoding token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return errors.New("token response has no access_token")
+	}
+
+	s.token = token.AccessToken
+	// Tokens without a lifetime are renewed after an hour
+	lifetime := time.Hour
+	if token.ExpiresIn > 0 {
+		lifetime = time.Duration(token.ExpiresIn) * time.Second
+	}
+	s.expires = time.Now().Add(lifetime)
+	log.Printf("Fetched backend access token from %s, valid for %s", s.tokenURL, lifetime)
+	return nil
+}
+
+// sigV4Signer signs requests with AWS Signature Version 4
+type sigV4Signer struct {
+	region       string
+	service      string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	maxBody      int64 // Largest body buffered to be hashed
+}
+
+// newSigV4Signer reads the signing settings and the standard AWS credential variables
+func newSigV4Signer() (*sigV4Signer, error) {
+	signer := &sigV4Signer{
+		region:       getEnv("BACKEND_SIGV4_REGION", os.Getenv("AWS_REGION")),
+		service:      lookupSetting("BACKEND_SIGV4_SERVICE"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		maxBody:      getEnvInt64("BACKEND_SIGV4_MAX_BODY_BYTES", 10<<20),
+	}
+	if signer.maxBody <= 0 {
+		return nil, fmt.Errorf("BACKEND_SIGV4_MAX_BODY_BYTES=%d must be positive", signer.maxBody)
+	}
+	if signer.region == "" || signer.service == "" {
+		return nil, errors.New("BACKEND_SIGV4_REGION (or AWS_REGION) and BACKEND_SIGV4_SERVICE must be set")
+	}
+	if signer.accessKey == "" || signer.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return signer, nil
+}
+
+// sigV4Escape percent-encodes a string as required by the canonical request
+func sigV4Escape(value string, keepSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', keepSlash && b == '/':
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// payloadHash returns the hash of the request body signed by SigV4. Bodies up to
+// BACKEND_SIGV4_MAX_BODY_BYTES are buffered to hash them. Larger ones are streamed unsigned
+// to S3, other services require the hash so they are refused.
+func (s *sigV4Signer) payloadHash(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	if req.ContentLength > s.maxBody {
+		if s.service == "s3" {
+			return sigV4UnsignedPayload, nil
+		}
+		return "", errSigV4BodyTooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, s.maxBody+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > s.maxBody {
+		// A body of unknown length turned out too large, what was read goes ahead of the rest
+		if s.service == "s3" {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(data), req.Body), req.Body}
+			return sigV4UnsignedPayload, nil
+		}
+		return "", errSigV4BodyTooLarge
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.ContentLength = int64(len(data))
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// sign adds the SigV4 Authorization header
+func (s *sigV4Signer) sign(req *http.Request) error {
+	payloadHash, err := s.payloadHash(req)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headers := map[string]string{
+		"host":                 host,
+		"x-amz-date":           amzDate,
+		"x-amz-content-sha256": payloadHash,
+	}
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+		headers["x-amz-security-token"] = s.sessionToken
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// S3 signs the path as sent, every other service signs it encoded once more
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if s.service != "s3" {
+		path = sigV4Escape(path, true)
+	}
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, sigV4Escape(key, false)+"="+sigV4Escape(value, false))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, strings.Join(params, "&"), canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/" + s.service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s.service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+	return nil
+}
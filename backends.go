@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Pool of backend instances requests are balanced across
+	backends *backendPool
+	// Returned when every backend is marked unhealthy
+	errNoHealthyBackend = errors.New("no healthy backend available")
+)
+
+// parseBackendURLs splits a comma separated BACKEND value into individual URLs
+func parseBackendURLs(value string) []string {
+	var urls []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			urls = append(urls, entry)
+		}
+	}
+	return urls
+}
+
+// backend is a single upstream instance
+type backend struct {
+	url          string
+	healthy      bool
+	healthySince time.Time // Zero for instances that were healthy from the start
+}
+
+// backendPool selects backends by health and slow-start weight
+type backendPool struct {
+	mutex          sync.RWMutex
+	backends       []*backend
+	healthInterval time.Duration // Interval between active health checks, 0 disables them
+	slowStart      time.Duration // Window over which a recovered backend ramps up to full weight
+}
+
+// newBackendPool creates a pool with all backends initially healthy
+func newBackendPool(urls []string, healthInterval, slowStart time.Duration) *backendPool {
+	pool := &backendPool{healthInterval: healthInterval, slowStart: slowStart}
+	for _, u := range urls {
+		pool.backends = append(pool.backends, &backend{url: u, healthy: true})
+	}
+	return pool
+}
+
+// weight returns the share of traffic a backend should receive, between 0 and 1
+func (p *backendPool) weight(b *backend, now time.Time) float64 {
+	if !b.healthy {
+		return 0
+	}
+	if p.slowStart <= 0 || b.healthySince.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(b.healthySince)
+	if elapsed >= p.slowStart {
+		return 1
+	}
+	// Never starve a warming backend completely
+	return max(float64(elapsed)/float64(p.slowStart), 0.05)
+}
+
+// pick selects a backend using weighted random choice
+func (p *backendPool) pick() (*backend, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	now := time.Now()
+	var total float64
+	for _, b := range p.backends {
+		total += p.weight(b, now)
+	}
+	if total == 0 {
+		return nil, errNoHealthyBackend
+	}
+
+	target := rand.Float64() * total
+	for _, b := range p.backends {
+		w := p.weight(b, now)
+		if w > 0 && target < w {
+			return b, nil
+		}
+		target -= w
+	}
+	// Floating point rounding can leave target just past the last weight
+	for i := len(p.backends) - 1; i >= 0; i-- {
+		if p.backends[i].healthy {
+			return p.backends[i], nil
+		}
+	}
+	return nil, errNoHealthyBackend
+}
+
+// setHealth records the outcome of a health observation for a backend
+func (p *backendPool) setHealth(b *backend, healthy bool, reason string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if b.healthy == healthy {
+		return
+	}
+	b.healthy = healthy
+	if healthy {
+		b.healthySince = time.Now()
+		log.Printf("Backend %s recovered, ramping up over %s", b.url, p.slowStart)
+	} else {
+		log.Printf("Backend %s marked unhealthy: %s", b.url, reason)
+	}
+}
+
+// markFailure takes a backend out of rotation after a failed request.
+// Without active health checks nothing would bring it back, so it is left alone.
+func (p *backendPool) markFailure(b *backend, err error) {
+	if p.healthInterval > 0 && len(p.backends) > 1 {
+		p.setHealth(b, false, err.Error())
+	}
+}
+
+// startHealthChecks probes every backend periodically until the context is done
+func (p *backendPool) startHealthChecks(ctx context.Context) {
+	if p.healthInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(p.healthInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for _, b := range p.backends {
+					err := probeBackend(ctx, b.url, p.healthInterval)
+					if err != nil {
+						p.setHealth(b, false, err.Error())
+					} else {
+						p.setHealth(b, true, "")
+					}
+				}
+			}
+		}
+	}()
+}
+
+// probeBackend performs a single GET against a backend and treats 5xx as unhealthy
+func probeBackend(ctx context.Context, url string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// writeMetrics appends backend health and weight gauges in Prometheus format
+func (p *backendPool) writeMetrics(sb *strings.Builder) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	now := time.Now()
+	sb.WriteString("# HELP backend_up Whether the backend is considered healthy\n")
+	sb.WriteString("# TYPE backend_up gauge\n")
+	for _, b := range p.backends {
+		up := 0
+		if b.healthy {
+			up = 1
+		}
+		sb.WriteString(fmt.Sprintf("backend_up{backend=\"%s\"} %d\n", b.url, up))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP backend_weight Current traffic weight of the backend including slow-start\n")
+	sb.WriteString("# TYPE backend_weight gauge\n")
+	for _, b := range p.backends {
+		sb.WriteString(fmt.Sprintf("backend_weight{backend=\"%s\"} %g\n", b.url, p.weight(b, now)))
+	}
+	sb.WriteString("\n")
+}
+
+// backendState is a point-in-time view of a backend for diagnostics
+type backendState struct {
+	URL          string  `json:"url"`
+	Healthy      bool    `json:"healthy"`
+	Weight       float64 `json:"weight"`
+	HealthySince string  `json:"healthy_since,omitempty"`
+}
+
+// snapshot returns the current state of every backend
+func (p *backendPool) snapshot() []backendState {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	now := time.Now()
+	states := make([]backendState, 0, len(p.backends))
+	for _, b := range p.backends {
+		state := backendState{URL: b.url, Healthy: b.healthy, Weight: p.weight(b, now)}
+		if !b.healthySince.IsZero() {
+			state.HealthySince = b.healthySince.UTC().Format(time.RFC3339)
+		}
+		states = append(states, state)
+	}
+	return states
+}
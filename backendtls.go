@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// backendConfig holds per-backend transport settings from the "backends" section of
+// CONFIG_FILE, keyed by backend URL. They are applied at startup.
+type backendConfig struct {
+	TLSSkipVerify bool   `json:"tls_skip_verify"` // Accept any certificate, for development only
+	CAFile        string `json:"ca_file"`         // PEM bundle trusted in addition to the system roots
+	ServerName    string `json:"server_name"`     // SNI and verification name when it differs from the URL host
+	HTTP2         *bool  `json:"http2"`           // Prefer (true) or disable (false) HTTP/2, unset keeps the default
+}
+
+// backendOrigin returns the scheme and host of a backend URL as the lookup key for its settings
+func backendOrigin(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("%q is not an absolute http or https URL", rawURL)
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
+
+// validate checks that the settings can be turned into a transport and do not contradict each other
+func (bc *backendConfig) validate(origin string) error {
+	hasTLSSettings := bc.TLSSkipVerify || bc.CAFile != "" || bc.ServerName != ""
+	if hasTLSSettings && !strings.HasPrefix(origin, "https://") {
+		return errors.New("tls_skip_verify, ca_file and server_name require an https URL")
+	}
+	if bc.TLSSkipVerify && (bc.CAFile != "" || bc.ServerName != "") {
+		return errors.New("ca_file and server_name have no effect with tls_skip_verify")
+	}
+	if bc.CAFile != "" {
+		if _, err := os.Stat(bc.CAFile); err != nil {
+			return fmt.Errorf("ca_file: %w", err)
+		}
+	}
+	return nil
+}
+
+// applyTLS sets the certificate verification settings of the backend on a TLS configuration
+func (bc *backendConfig) applyTLS(config *tls.Config) error {
+	config.InsecureSkipVerify = bc.TLSSkipVerify
+	config.ServerName = bc.ServerName
+
+	if bc.CAFile != "" {
+		pem, err := os.ReadFile(bc.CAFile)
+		if err != nil {
+			return err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + bc.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	return nil
+}
+
+// transport derives a transport for one backend from the shared one
+func (bc *backendConfig) transport(base *http.Transport) (*http.Transport, error) {
+	t := base.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	if err := bc.applyTLS(t.TLSClientConfig); err != nil {
+		return nil, err
+	}
+
+	if bc.HTTP2 != nil {
+		t.ForceAttemptHTTP2 = *bc.HTTP2
+		if !*bc.HTTP2 {
+			// A non-nil empty map turns off the transport's built-in HTTP/2 support
+			t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+			t.TLSClientConfig.NextProtos = []string{"http/1.1"}
+		}
+	}
+	return t, nil
+}
+
+// backendConfigFor returns the settings of the "backends" section for a backend URL
+func backendConfigFor(rawURL string) (backendConfig, bool) {
+	origin, err := backendOrigin(rawURL)
+	if err != nil {
+		return backendConfig{}, false
+	}
+	for key, bc := range getConfig().Backends {
+		if keyOrigin, err := backendOrigin(key); err == nil && keyOrigin == origin {
+			return bc, true
+		}
+	}
+	return backendConfig{}, false
+}
+
+// backendTransport routes each request through the transport configured for its backend
+type backendTransport struct {
+	base     *http.Transport
+	byOrigin map[string]*http.Transport
+}
+
+// newBackendTransport builds one transport per backend with overrides, the rest share base
+func newBackendTransport(base *http.Transport, overrides map[string]backendConfig) (http.RoundTripper, error) {
+	if len(overrides) == 0 {
+		return base, nil
+	}
+	bt := &backendTransport{base: base, byOrigin: make(map[string]*http.Transport)}
+	for rawURL, bc := range overrides {
+		origin, err := backendOrigin(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		t, err := bc.transport(base)
+		if err != nil {
+			return nil, fmt.Errorf("backends[%q]: %w", rawURL, err)
+		}
+		if bc.TLSSkipVerify {
+			log.Printf("WARNING: TLS certificate verification is disabled for backend %s, do not use this in production", origin)
+		}
+		bt.byOrigin[origin] = t
+	}
+	return bt, nil
+}
+
+// RoundTrip sends the request with the transport of its backend
+func (bt *backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t, ok := bt.byOrigin[strings.ToLower(req.URL.Scheme+"://"+req.URL.Host)]; ok {
+		return t.RoundTrip(req)
+	}
+	return bt.base.RoundTrip(req)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Build metadata injected at build time, e.g.
+// go build -ldflags "-X main.buildVersion=1.2.3 -X main.buildCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+// Metadata that is neither injected nor embedded by the Go toolchain is left empty, the
+// version then reads "dev" so an unversioned build is never mistaken for a release.
+var (
+	buildVersion = ""
+	buildCommit  = ""
+	buildDate    = ""
+)
+
+// Initialize build metadata not injected with -ldflags from the embedded module and VCS information
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if buildVersion == "" {
+		buildVersion = "dev"
+		// The toolchain records the module version for go install, and newer releases derive
+		// one from the VCS checkout
+		if ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			buildVersion = info.Main.Version
+		}
+	}
+	if !ok {
+		return
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if buildCommit == "" {
+				buildCommit = setting.Value
+			}
+		case "vcs.time":
+			if buildDate == "" {
+				buildDate = setting.Value
+			}
+		}
+	}
+}
+
+// buildInfo describes the running binary
+type buildInfo struct {
+	Version   string            `json:"version"`
+	Commit    string            `json:"commit"`
+	BuildDate string            `json:"build_date"`
+	GoVersion string            `json:"go_version"`
+	StartTime string            `json:"start_time"`
+	Resource  map[string]string `json:"resource,omitempty"`
+}
+
+// versionResponse is the body of /version, which also has a plain text form
+type versionResponse buildInfo
+
+// writeText writes the version as "Name: value" lines
+func (v versionResponse) writeText(w io.Writer) {
+	fmt.Fprintf(w, "Version: %s\nCommit: %s\nBuild-Date: %s\n", v.Version, v.Commit, v.BuildDate)
+}
+
+// currentBuildInfo returns the metadata of the running binary
+func currentBuildInfo() buildInfo {
+	return buildInfo{
+		Version:   version,
+		Commit:    buildCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		StartTime: startTime.UTC().Format(time.RFC3339),
+	}
+}
+
+// InfoHandler returns build metadata as JSON
+func InfoHandler(w http.ResponseWriter, r *http.Request) {
+	// Only process requests for exact "/info" path
+	if r.URL.Path != "/info" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	info := currentBuildInfo()
+	info.Resource = resourceAttributes()
+	writeResponse(w, r, http.StatusOK, info)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bound of a background revalidation, which is not tied to any client request
+const cacheRevalidateTimeout = 30 * time.Second
+
+// Request headers that select a cache variant, responses varying on anything else are not stored
+var cacheKeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+
+// Statuses whose responses may be stored
+var cacheableStatuses = []int{
+	http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMovedPermanently,
+	http.StatusNotFound, http.StatusGone,
+}
+
+// Shared cache of backend responses, nil when CACHE_ENABLED is not set
+var responseCache *httpCache
+
+// Initialize response cache settings from environment variables
+func init() {
+	if lookupSetting("CACHE_ENABLED") != "true" {
+		return
+	}
+	responseCache = &httpCache{
+		defaultTTL:           getEnvDuration("CACHE_DEFAULT_TTL", 0),
+		staleWhileRevalidate: getEnvDuration("CACHE_STALE_WHILE_REVALIDATE", 0),
+		staleIfError:         getEnvDuration("CACHE_STALE_IF_ERROR", 0),
+		maxEntries:           int(getEnvInt64("CACHE_MAX_ENTRIES", 1000)),
+		maxEntryBytes:        getEnvInt64("CACHE_MAX_ENTRY_BYTES", 1<<20),
+		entries:              make(map[string]*list.Element),
+		lru:                  list.New(),
+	}
+}
+
+// cacheEntry is a stored backend response
+type cacheEntry struct {
+	key                  string
+	status               int
+	header               http.Header
+	trailer              http.Header
+	body                 []byte
+	stored               time.Time
+	freshUntil           time.Time
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	revalidating         atomic.Bool
+}
+
+// httpCache is an in-memory LRU cache of backend responses following the shared cache rules
+// of RFC 9111, extended with the stale-while-revalidate and stale-if-error directives of RFC 5861
+type httpCache struct {
+	// Lifetime of responses that carry no freshness information
+	defaultTTL time.Duration
+	// Upper bounds of serving expired entries, backend directives may only shorten them
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	maxEntries           int
+	maxEntryBytes        int64
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	results map[string]int64
+}
+
+// cacheStats is a snapshot of the cache for diagnostics
+type cacheStats struct {
+	Entries int              `json:"entries"`
+	Results map[string]int64 `json:"results"`
+}
+
+// cacheKey identifies the stored variant for a request, "" when the request bypasses the cache.
+// Requests with credentials, including cookies, bypass it since their responses may be personal.
+func cacheKey(r *http.Request) string {
+	if r.Method != http.MethodGet || r.ContentLength != 0 ||
+		r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" || r.Header.Get("Range") != "" ||
+		hasDirective(r.Header, "no-store") {
+		return ""
+	}
+	var key strings.Builder
+	key.WriteString(r.URL.RequestURI())
+	// Backends see the client's Host on some routes and may answer differently per host
+	fmt.Fprintf(&key, "\nHost: %s", getConfig().route(r.URL.Path).outboundHost(r))
+	for _, name := range cacheKeyHeaders {
+		fmt.Fprintf(&key, "\n%s: %s", name, strings.Join(r.Header.Values(name), ", "))
+	}
+	return key.String()
+}
+
+// cacheControl parses the Cache-Control header into lower-case directives and their values
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, field := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(field, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// hasDirective reports whether Cache-Control contains a directive
+func hasDirective(header http.Header, name string) bool {
+	_, ok := cacheControl(header)[name]
+	return ok
+}
+
+// directiveSeconds returns a delta-seconds directive value
+func directiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// newCacheEntry builds an entry from a response, or returns nil when it must not be stored
+func (c *httpCache) newCacheEntry(key string, resp *http.Response, body []byte) *cacheEntry {
+	directives := cacheControl(resp.Header)
+	if !slices.Contains(cacheableStatuses, resp.StatusCode) || resp.Header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	for _, name := range []string{"no-store", "private"} {
+		if _, ok := directives[name]; ok {
+			return nil
+		}
+	}
+	for _, field := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(field, ",") {
+			if !slices.Contains(cacheKeyHeaders, http.CanonicalHeaderKey(strings.TrimSpace(name))) {
+				return nil
+			}
+		}
+	}
+
+	lifetime := c.defaultTTL
+	if maxAge, ok := directiveSeconds(directives, "s-maxage"); ok {
+		lifetime = maxAge
+	} else if maxAge, ok := directiveSeconds(directives, "max-age"); ok {
+		lifetime = maxAge
+	}
+	if _, ok := directives["no-cache"]; ok {
+		lifetime = 0
+	}
+	entry := &cacheEntry{
+		key:                  key,
+		status:               resp.StatusCode,
+		header:               resp.Header.Clone(),
+		trailer:              resp.Trailer.Clone(),
+		body:                 body,
+		stored:               time.Now(),
+		staleWhileRevalidate: c.staleWhileRevalidate,
+		staleIfError:         c.staleIfError,
+	}
+	entry.freshUntil = entry.stored.Add(lifetime)
+	if value, ok := directiveSeconds(directives, "stale-while-revalidate"); ok {
+		entry.staleWhileRevalidate = min(value, c.staleWhileRevalidate)
+	}
+	if value, ok := directiveSeconds(directives, "stale-if-error"); ok {
+		entry.staleIfError = min(value, c.staleIfError)
+	}
+	// Revalidation is required before every reuse, so keep the entry only as an error fallback
+	if _, ok := directives["must-revalidate"]; ok {
+		entry.staleWhileRevalidate = 0
+	}
+	if lifetime <= 0 && entry.staleWhileRevalidate <= 0 && entry.staleIfError <= 0 {
+		return nil
+	}
+	return entry
+}
+
+// response returns a copy of the stored response for one client
+func (e *cacheEntry) response(req *http.Request, state string) *http.Response {
+	header := e.header.Clone()
+	header.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	header.Set("X-Cache", state)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.status, http.StatusText(e.status)),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Trailer:       e.trailer.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// get returns the entry stored under a key and marks it recently used
+func (c *httpCache) get(key string) *cacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.freshUntil.Add(max(entry.staleWhileRevalidate, entry.staleIfError))) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return entry
+}
+
+// put stores an entry, evicting the least recently used ones beyond the limit
+func (c *httpCache) put(entry *cacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[entry.key]; ok {
+		c.lru.Remove(element)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// count records how a request was answered
+func (c *httpCache) count(result string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.results == nil {
+		c.results = make(map[string]int64)
+	}
+	c.results[result]++
+}
+
+// store reads a fresh backend response and keeps it when cacheable. The returned response
+// replaces the one passed in, since its body may have been consumed.
+func (c *httpCache) store(key string, resp *http.Response) (*http.Response, error) {
+	data, err := io.ReadAll(io.LimitReader(resp.Body, c.maxEntryBytes+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(data)) > c.maxEntryBytes {
+		// Too large to store, hand the remaining body through unbuffered
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	if entry := c.newCacheEntry(key, resp, data); entry != nil {
+		c.put(entry)
+	}
+	return resp, nil
+}
+
+// revalidate refreshes a stale entry in the background, keeping it when the backend fails
+func (c *httpCache) revalidate(entry *cacheEntry, req *http.Request, fetch func(*http.Request) (*http.Response, error)) {
+	if !entry.revalidating.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer entry.revalidating.Store(false)
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), cacheRevalidateTimeout)
+		defer cancel()
+		resp, err := fetch(req.Clone(ctx))
+		if err != nil {
+			return
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			resp.Body.Close()
+			return
+		}
+		if resp, err = c.store(entry.key, resp); err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}()
+}
+
+// do answers a backend request from the cache where allowed and fetches it otherwise. Expired
+// entries are served while a refresh runs in the background within the stale-while-revalidate
+// bound, and in place of backend errors within the stale-if-error bound.
+func (c *httpCache) do(r, req *http.Request, fetch func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if c == nil {
+		return fetch(req)
+	}
+	key := cacheKey(r)
+	if key == "" {
+		return fetch(req)
+	}
+
+	entry := c.get(key)
+	if entry != nil && !hasDirective(r.Header, "no-cache") {
+		now := time.Now()
+		if now.Before(entry.freshUntil) {
+			c.count("hit")
+			return entry.response(req, "HIT"), nil
+		}
+		if now.Before(entry.freshUntil.Add(entry.staleWhileRevalidate)) {
+			c.revalidate(entry, req, fetch)
+			c.count("stale")
+			return entry.response(req, "STALE"), nil
+		}
+	}
+
+	resp, err := fetch(req)
+	failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+	// A client that gave up has no use for a fallback
+	if failed && entry != nil && req.Context().Err() == nil &&
+		time.Now().Before(entry.freshUntil.Add(entry.staleIfError)) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		c.count("stale_if_error")
+		return entry.response(req, "STALE"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.count("miss")
+	if resp, err = c.store(key, resp); err != nil {
+		return nil, err
+	}
+	resp.Header.Set("X-Cache", "MISS")
+	return resp, nil
+}
+
+// stats returns the number of entries and how requests were answered
+func (c *httpCache) stats() *cacheStats {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	results := make(map[string]int64, len(c.results))
+	for result, count := range c.results {
+		results[result] = count
+	}
+	return &cacheStats{Entries: c.lru.Len(), Results: results}
+}
+
+// writeMetrics appends response cache metrics in Prometheus format
+func (c *httpCache) writeMetrics(sb *strings.Builder) {
+	stats := c.stats()
+	if stats == nil {
+		return
+	}
+
+	sb.WriteString("# HELP cache_requests_total Cacheable requests by how they were answered\n")
+	sb.WriteString("# TYPE cache_requests_total counter\n")
+	for _, result := range []string{"hit", "miss", "stale", "stale_if_error"} {
+		sb.WriteString(fmt.Sprintf("cache_requests_total{result=\"%s\"} %d\n", result, stats.Results[result]))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP cache_entries Number of responses held in the cache\n")
+	sb.WriteString("# TYPE cache_entries gauge\n")
+	sb.WriteString(fmt.Sprintf("cache_entries %d\n", stats.Entries))
+	sb.WriteString("\n")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// Share one backend call between identical concurrent GET requests
+	coalesceEnabled bool
+	// Request headers that must match for requests to be considered identical
+	coalesceKeyHeaders []string
+	// Largest response body buffered to be shared, larger ones are streamed to each request
+	coalesceMaxBytes int64
+	// In-flight backend calls by request key
+	coalesceCalls = struct {
+		mutex sync.Mutex
+		calls map[string]*coalescedCall
+	}{calls: make(map[string]*coalescedCall)}
+	// Requests answered from another request's backend call
+	coalescedRequests atomic.Int64
+)
+
+// Initialize request coalescing settings from environment variables
+func init() {
+	coalesceEnabled = lookupSetting("COALESCE_REQUESTS") == "true"
+	headers := getEnv("COALESCE_KEY_HEADERS", "Accept,Accept-Encoding,Accept-Language,Authorization,Cookie,Range")
+	for _, name := range strings.Split(headers, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			coalesceKeyHeaders = append(coalesceKeyHeaders, http.CanonicalHeaderKey(name))
+		}
+	}
+	coalesceMaxBytes = getEnvInt64("COALESCE_MAX_BYTES", 1<<20)
+	if coalesceMaxBytes <= 0 {
+		log.Printf("Invalid COALESCE_MAX_BYTES=%d, using 1MiB", coalesceMaxBytes)
+		recordEnvError(fmt.Errorf("COALESCE_MAX_BYTES=%d must be positive", coalesceMaxBytes))
+		coalesceMaxBytes = 1 << 20
+	}
+}
+
+// coalescedResponse is a fully read backend response that can be handed to every waiter
+type coalescedResponse struct {
+	resp *http.Response
+	body []byte
+}
+
+// coalescedCall is a backend call shared by identical requests. It is cancelled once every
+// waiter left, each waiter gives up on its own deadline.
+type coalescedCall struct {
+	done     chan struct{}
+	response *coalescedResponse // Buffered response handed to every waiter
+	stream   *http.Response     // Response too large to share, taken over by one waiter
+	err      error
+	waiters  int // Guarded by coalesceCalls.mutex, like stream once the call is done
+	cancel   context.CancelFunc
+}
+
+// coalesceKey identifies requests that can share a backend call, "" when the request is not eligible
+func coalesceKey(r *http.Request) string {
+	if !coalesceEnabled || r.Method != http.MethodGet || r.ContentLength != 0 {
+		return ""
+	}
+	var key strings.Builder
+	key.WriteString(r.URL.RequestURI())
+	// Backends see the client's Host on some routes and may answer differently per host
+	fmt.Fprintf(&key, "\nHost: %s", getConfig().route(r.URL.Path).outboundHost(r))
+	for _, name := range coalesceKeyHeaders {
+		fmt.Fprintf(&key, "\n%s: %s", name, strings.Join(r.Header.Values(name), ", "))
+	}
+	return key.String()
+}
+
+// coalescable reports whether a response is small enough to be buffered and shared. Event
+// streams and bodies of unknown length may never end, so they are streamed instead.
+func coalescable(resp *http.Response) bool {
+	if resp.ContentLength < 0 || resp.ContentLength > coalesceMaxBytes {
+		return false
+	}
+	if responseMaxBytes > 0 && resp.ContentLength > responseMaxBytes {
+		// Streamed so the limit is enforced like for any other response
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType != "text/event-stream"
+}
+
+// run performs the backend call and hands the outcome to the waiters
+func (c *coalescedCall) run(key string, req *http.Request) {
+	var response *coalescedResponse
+	resp, err := backendClient.Do(req)
+	if err == nil && coalescable(resp) {
+		var data []byte
+		data, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			response = &coalescedResponse{resp: resp, body: data}
+		}
+		resp = nil
+	}
+
+	coalesceCalls.mutex.Lock()
+	delete(coalesceCalls.calls, key)
+	c.response, c.err = response, err
+	if resp != nil && c.waiters > 0 {
+		c.stream = resp
+	} else if resp != nil {
+		resp.Body.Close()
+	}
+	coalesceCalls.mutex.Unlock()
+	close(c.done)
+}
+
+// leave drops a waiter, the last one cancels the call and closes a response nobody took over
+func (c *coalescedCall) leave() {
+	coalesceCalls.mutex.Lock()
+	c.waiters--
+	last := c.waiters == 0
+	stream := c.stream
+	if last {
+		c.stream = nil
+	}
+	coalesceCalls.mutex.Unlock()
+
+	if last {
+		if stream != nil {
+			stream.Body.Close()
+		}
+		c.cancel()
+	}
+}
+
+// takeStream hands the unshared response to the first waiter asking for it
+func (c *coalescedCall) takeStream() *http.Response {
+	coalesceCalls.mutex.Lock()
+	defer coalesceCalls.mutex.Unlock()
+	stream := c.stream
+	c.stream = nil
+	return stream
+}
+
+// doBackendRequest sends a request to the backend. Identical concurrent GETs wait for a single
+// call whose buffered response is copied to each of them. When the response is too large to
+// buffer, one of them streams it and the others send their own request.
+func doBackendRequest(r, req *http.Request) (*http.Response, error) {
+	key := coalesceKey(r)
+	if key == "" {
+		return backendClient.Do(req)
+	}
+
+	coalesceCalls.mutex.Lock()
+	call, shared := coalesceCalls.calls[key]
+	if !shared {
+		// The call outlives the request that started it and carries no deadline of its own
+		ctx, cancel := context.WithCancel(context.WithoutCancel(req.Context()))
+		call = &coalescedCall{done: make(chan struct{}), cancel: cancel}
+		coalesceCalls.calls[key] = call
+		// Waiters have budgets of their own, the backend is not given the first one's
+		sharedReq := req.WithContext(ctx)
+		sharedReq.Header = req.Header.Clone()
+		sharedReq.Header.Del(requestTimeoutHeader)
+		go call.run(key, sharedReq)
+	}
+	call.waiters++
+	coalesceCalls.mutex.Unlock()
+
+	select {
+	case <-call.done:
+	case <-req.Context().Done():
+		call.leave()
+		return nil, req.Context().Err()
+	}
+
+	switch {
+	case call.err != nil:
+		call.leave()
+		return nil, call.err
+	case call.response != nil:
+		call.leave()
+		if shared {
+			coalescedRequests.Add(1)
+		}
+		return call.response.clone(), nil
+	}
+	if resp := call.takeStream(); resp != nil {
+		// The waiter's deadline and disconnect now end the call, which it leaves with the body
+		stop := context.AfterFunc(req.Context(), call.cancel)
+		resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() {
+			stop()
+			call.leave()
+		}}
+		return resp, nil
+	}
+	call.leave()
+	return backendClient.Do(req)
+}
+
+// releasingBody runs release once the body is closed
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+// Close closes the body and releases what it held
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// clone returns a response with its own headers and body reader
+func (c *coalescedResponse) clone() *http.Response {
+	resp := *c.resp
+	resp.Header = c.resp.Header.Clone()
+	resp.Trailer = c.resp.Trailer.Clone()
+	resp.Body = io.NopCloser(bytes.NewReader(c.body))
+	resp.ContentLength = int64(len(c.body))
+	return &resp
+}
+
+// writeCoalesceMetrics appends the coalescing counter in Prometheus format
+func writeCoalesceMetrics(sb *strings.Builder) {
+	sb.WriteString("# HELP backend_coalesced_requests_total Requests answered by sharing another request's backend call\n")
+	sb.WriteString("# TYPE backend_coalesced_requests_total counter\n")
+	sb.WriteString(fmt.Sprintf("backend_coalesced_requests_total %d\n", coalescedRequests.Load()))
+	sb.WriteString("\n")
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// Encodings the proxy may apply to uncompressed responses, in order of preference
+	compressionEncodings []string
+	// Responses with a known length below this size are sent uncompressed
+	compressionMinBytes int64
+	// Compression levels per encoding
+	gzipLevel   int
+	brotliLevel int
+	zstdLevel   zstd.EncoderLevel
+)
+
+// Initialize response compression settings from environment variables
+func init() {
+	// COMPRESSION_ENCODINGS is a comma separated preference list of zstd, br and gzip, empty disables compression
+	for _, encoding := range strings.Split(getEnv("COMPRESSION_ENCODINGS", ""), ",") {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		switch encoding {
+		case "":
+		case "gzip", "br", "zstd":
+			compressionEncodings = append(compressionEncodings, encoding)
+		default:
+			log.Printf("Ignoring unsupported encoding %q in COMPRESSION_ENCODINGS", encoding)
+			recordEnvError(fmt.Errorf("COMPRESSION_ENCODINGS entry %q is not one of zstd, br and gzip", encoding))
+		}
+	}
+	compressionMinBytes = getEnvInt64("COMPRESSION_MIN_BYTES", 1024)
+	gzipLevel = int(getEnvInt64("COMPRESSION_GZIP_LEVEL", gzip.DefaultCompression))
+	brotliLevel = int(getEnvInt64("COMPRESSION_BROTLI_LEVEL", 4))
+	zstdLevel = zstd.EncoderLevelFromZstd(int(getEnvInt64("COMPRESSION_ZSTD_LEVEL", 3)))
+}
+
+// acceptedEncodings parses Accept-Encoding into quality values by coding
+func acceptedEncodings(r *http.Request) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, entry := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		quality := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if q, err := strconv.ParseFloat(value, 64); err == nil {
+				quality = q
+			}
+		}
+		accepted[coding] = quality
+	}
+	return accepted
+}
+
+// acceptsEncoding reports whether the client accepts a content coding
+func acceptsEncoding(accepted map[string]float64, coding string) bool {
+	if q, ok := accepted[coding]; ok {
+		return q > 0
+	}
+	// "x-gzip" is an alias of gzip
+	if coding == "gzip" {
+		if q, ok := accepted["x-gzip"]; ok {
+			return q > 0
+		}
+	}
+	if q, ok := accepted["*"]; ok {
+		return q > 0
+	}
+	return false
+}
+
+// decodeUnacceptedEncoding transparently decompresses a backend response whose encoding
+// the client did not ask for. The returned body must be closed to release the decoder.
+func decodeUnacceptedEncoding(r *http.Request, resp *http.Response, body io.Reader) (io.ReadCloser, error) {
+	coding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	switch coding {
+	case "gzip", "x-gzip", "deflate", "br", "zstd":
+		// Other clients get this response decoded or not, depending on what they accept
+		addVary(resp.Header, "Accept-Encoding")
+	default:
+		// Unknown codings are passed through untouched
+		return io.NopCloser(body), nil
+	}
+	if acceptsEncoding(acceptedEncodings(r), coding) {
+		return io.NopCloser(body), nil
+	}
+
+	var decoded io.ReadCloser
+	switch coding {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		decoded = reader
+	case "deflate":
+		// HTTP deflate is the zlib format, not a raw deflate stream
+		reader, err := zlib.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		decoded = reader
+	case "br":
+		decoded = io.NopCloser(brotli.NewReader(body))
+	case "zstd":
+		decoder, err := zstd.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		decoded = decoder.IOReadCloser()
+	}
+
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	weakenETag(resp.Header)
+	resp.ContentLength = -1
+	return decoded, nil
+}
+
+// addVary lists a request header in Vary unless it is already listed
+func addVary(h http.Header, name string) {
+	for _, field := range h.Values("Vary") {
+		for _, listed := range strings.Split(field, ",") {
+			if listed = strings.TrimSpace(listed); listed == "*" || strings.EqualFold(listed, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// weakenETag marks a strong ETag as weak, a decoded or compressed payload is no longer
+// byte for byte the representation the backend issued it for
+func weakenETag(h http.Header) {
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
+}
+
+// isCompressible reports whether a content type benefits from compression
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "xml") ||
+		mediaType == "application/javascript"
+}
+
+// negotiateCompression picks the encoding to apply to a backend response, or "" for none.
+// Responses it could compress are marked as varying by Accept-Encoding.
+func negotiateCompression(r *http.Request, resp *http.Response) string {
+	if len(compressionEncodings) == 0 || r.Method == http.MethodHead {
+		return ""
+	}
+	// Partial content and already encoded payloads must keep their exact bytes
+	if resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified || resp.Header.Get("Content-Encoding") != "" ||
+		resp.Header.Get("Content-Range") != "" {
+		return ""
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < compressionMinBytes {
+		return ""
+	}
+	if !isCompressible(resp.Header.Get("Content-Type")) {
+		return ""
+	}
+
+	// Whether this response is compressed depends on the client from here on
+	addVary(resp.Header, "Accept-Encoding")
+	accepted := acceptedEncodings(r)
+	for _, encoding := range compressionEncodings {
+		if acceptsEncoding(accepted, encoding) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressWriter encodes everything written to the wrapped ResponseWriter
+type compressWriter struct {
+	http.ResponseWriter
+	encoder interface {
+		io.WriteCloser
+		Flush() error
+	}
+}
+
+// newCompressWriter prepares the response headers and returns a writer applying the encoding
+func newCompressWriter(w http.ResponseWriter, encoding string) (*compressWriter, error) {
+	cw := &compressWriter{ResponseWriter: w}
+	switch encoding {
+	case "gzip":
+		encoder, err := gzip.NewWriterLevel(w, gzipLevel)
+		if err != nil {
+			return nil, err
+		}
+		cw.encoder = encoder
+	case "br":
+		cw.encoder = brotli.NewWriterLevel(w, brotliLevel)
+	case "zstd":
+		encoder, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstdLevel))
+		if err != nil {
+			return nil, err
+		}
+		cw.encoder = encoder
+	}
+
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Del("Content-Length")
+	weakenETag(w.Header())
+	return cw, nil
+}
+
+// Write compresses the payload
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	return cw.encoder.Write(b)
+}
+
+// Flush pushes buffered compressed data to the client
+func (cw *compressWriter) Flush() {
+	if cw.encoder.Flush() == nil {
+		http.NewResponseController(cw.ResponseWriter).Flush()
+	}
+}
+
+// Close writes the end of the compressed stream
+func (cw *compressWriter) Close() error {
+	return cw.encoder.Close()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Path of the optional JSON configuration file for structured settings
+	configFile = lookupSetting("CONFIG_FILE")
+	// Currently active file configuration, never nil after init
+	activeConfig atomic.Pointer[fileConfig]
+)
+
+// fileConfig holds the settings that do not fit into plain environment variables
+type fileConfig struct {
+	MockBackend mockBackendConfig        `json:"mock_backend"`
+	Routes      map[string]routeConfig   `json:"routes"`
+	Backends    map[string]backendConfig `json:"backends"`
+	Listeners   []listenerConfig         `json:"listeners"`
+	Health      healthConfig             `json:"health"`
+	Probes      map[string]probeConfig   `json:"probes"`
+}
+
+// duration is a time.Duration that unmarshals from strings like "250ms"
+type duration time.Duration
+
+// UnmarshalJSON parses a Go duration string
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string like \"250ms\": %w", err)
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// MarshalJSON formats the duration as a Go duration string
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Initialize the file configuration
+func init() {
+	cfg, err := loadConfigFile(configFile)
+	recordConfigLoad(err)
+	if err != nil {
+		log.Fatalf("Failed to load CONFIG_FILE=%s: %v", configFile, err)
+	}
+	activeConfig.Store(cfg)
+}
+
+// loadConfigFile reads and parses the configuration file, an empty path yields the defaults
+func loadConfigFile(path string) (*fileConfig, error) {
+	cfg := &fileConfig{}
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = expandConfigEnv(data); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, describeJSONError(data, err)
+	}
+	// Misspelled keys would otherwise be ignored without notice
+	var document any
+	json.Unmarshal(data, &document)
+	if err := checkUnknownKeys(document, reflect.TypeFor[fileConfig](), ""); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validate checks settings that cannot be expressed through JSON types alone
+func (c *fileConfig) validate() error {
+	if err := c.MockBackend.validate(); err != nil {
+		return fmt.Errorf("mock_backend.%w", err)
+	}
+	for _, path := range sortedKeys(c.Routes) {
+		rc := c.Routes[path]
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("routes: path %q must start with /", path)
+		}
+		if err := rc.validate(); err != nil {
+			return fmt.Errorf("routes[%q]: %w", path, err)
+		}
+	}
+	origins := make(map[string]string)
+	for _, rawURL := range sortedKeys(c.Backends) {
+		bc := c.Backends[rawURL]
+		origin, err := backendOrigin(rawURL)
+		if err != nil {
+			return fmt.Errorf("backends: %w", err)
+		}
+		// Keys are matched by origin, so two spellings of one origin would conflict
+		if other, ok := origins[origin]; ok {
+			return fmt.Errorf("backends: %q and %q refer to the same origin %s", other, rawURL, origin)
+		}
+		origins[origin] = rawURL
+		if err := bc.validate(origin); err != nil {
+			return fmt.Errorf("backends[%q]: %w", rawURL, err)
+		}
+	}
+	addresses := make(map[string]int)
+	for i, lc := range c.Listeners {
+		if err := lc.validate(); err != nil {
+			return fmt.Errorf("listeners[%d]: %w", i, err)
+		}
+		if first, ok := addresses[lc.Address]; ok {
+			return fmt.Errorf("listeners[%d]: address %s is already used by listeners[%d]", i, lc.Address, first)
+		}
+		addresses[lc.Address] = i
+	}
+	if err := c.Health.validate(); err != nil {
+		return fmt.Errorf("health.%w", err)
+	}
+	for _, name := range sortedKeys(c.Probes) {
+		pc := c.Probes[name]
+		if !probeNamePattern.MatchString(name) {
+			return fmt.Errorf("probes: name %q may only contain letters, digits, _, ., : and -", name)
+		}
+		if err := pc.validate(); err != nil {
+			return fmt.Errorf("probes[%q]: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// getConfig returns the active file configuration
+func getConfig() *fileConfig {
+	return activeConfig.Load()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Outcome of configuration loads for metrics
+var configReloads struct {
+	mutex       sync.Mutex
+	results     map[string]int64
+	lastSuccess time.Time
+}
+
+// recordConfigLoad counts a configuration load and remembers when the last one succeeded
+func recordConfigLoad(err error) {
+	configReloads.mutex.Lock()
+	defer configReloads.mutex.Unlock()
+
+	if configReloads.results == nil {
+		configReloads.results = make(map[string]int64)
+	}
+	if err != nil {
+		configReloads.results["failure"]++
+		return
+	}
+	configReloads.results["success"]++
+	configReloads.lastSuccess = time.Now()
+}
+
+// watchConfigReload reloads CONFIG_FILE whenever the process receives SIGHUP
+func watchConfigReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadConfig()
+	}
+}
+
+// Sections only read at startup, a reload cannot apply changes to them
+var startupOnlySections = []string{"backends", "listeners"}
+
+// reloadConfig swaps in a freshly parsed configuration file, keeping the old one on failure
+func reloadConfig() {
+	cfg, err := loadConfigFile(configFile)
+	if err == nil {
+		err = checkStartupOnlySections(getConfig(), cfg)
+	}
+	recordConfigLoad(err)
+	if err != nil {
+		log.Printf("Config reload of CONFIG_FILE=%s failed, keeping previous configuration: %v", configFile, err)
+		return
+	}
+
+	previous := activeConfig.Swap(cfg)
+	changes := diffConfig(previous, cfg)
+	// Values may hold secrets expanded from the environment
+	for i, change := range changes {
+		if change.Old != nil {
+			changes[i].Old = redactValue(change.Key, change.Old)
+		}
+		if change.New != nil {
+			changes[i].New = redactValue(change.Key, change.New)
+		}
+	}
+	entry, _ := json.Marshal(map[string]any{
+		"event":   "config_reload",
+		"file":    configFile,
+		"changes": changes,
+	})
+	log.Printf("Config reloaded: %s", entry)
+}
+
+// checkStartupOnlySections rejects a configuration that changes sections only read at startup,
+// applying the rest of it would leave the running instance different from its file
+func checkStartupOnlySections(previous, current *fileConfig) error {
+	var changed []string
+	for _, change := range diffConfig(previous, current) {
+		section, _, _ := strings.Cut(change.Key, ".")
+		section, _, _ = strings.Cut(section, "[")
+		if slices.Contains(startupOnlySections, section) && !slices.Contains(changed, section) {
+			changed = append(changed, section)
+		}
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("%s can only be changed by a restart", strings.Join(changed, " and "))
+	}
+	return nil
+}
+
+// configChange describes a single key whose value differs between two configurations
+type configChange struct {
+	Key string `json:"key"`
+	Old any    `json:"old,omitempty"`
+	New any    `json:"new,omitempty"`
+}
+
+// diffConfig lists the keys added, removed or modified between two configurations
+func diffConfig(previous, current *fileConfig) []configChange {
+	before, after := flattenConfig(previous), flattenConfig(current)
+
+	keys := make(map[string]bool)
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	changes := []configChange{}
+	for _, key := range sorted {
+		if !reflect.DeepEqual(before[key], after[key]) {
+			changes = append(changes, configChange{Key: key, Old: before[key], New: after[key]})
+		}
+	}
+	return changes
+}
+
+// flattenConfig maps every leaf of the JSON form of a configuration to a dotted key
+func flattenConfig(cfg *fileConfig) map[string]any {
+	leaves := make(map[string]any)
+	if cfg == nil {
+		return leaves
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return leaves
+	}
+	var tree any
+	json.Unmarshal(data, &tree)
+
+	var walk func(prefix string, node any)
+	walk = func(prefix string, node any) {
+		switch value := node.(type) {
+		case map[string]any:
+			for key, child := range value {
+				walk(strings.TrimPrefix(prefix+"."+key, "."), child)
+			}
+		case []any:
+			for i, child := range value {
+				walk(fmt.Sprintf("%s[%d]", prefix, i), child)
+			}
+		case nil:
+		default:
+			leaves[prefix] = value
+		}
+	}
+	walk("", tree)
+	return leaves
+}
+
+// writeConfigReloadMetrics appends configuration load metrics in Prometheus format
+func writeConfigReloadMetrics(sb *strings.Builder) {
+	configReloads.mutex.Lock()
+	defer configReloads.mutex.Unlock()
+
+	sb.WriteString("# HELP config_last_reload_success_timestamp Unix time of the last successful configuration load\n")
+	sb.WriteString("# TYPE config_last_reload_success_timestamp gauge\n")
+	var last float64
+	if !configReloads.lastSuccess.IsZero() {
+		last = float64(configReloads.lastSuccess.UnixMilli()) / 1000
+	}
+	sb.WriteString(fmt.Sprintf("config_last_reload_success_timestamp %.3f\n", last))
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP config_reload_total Configuration loads by result\n")
+	sb.WriteString("# TYPE config_reload_total counter\n")
+	for _, result := range []string{"success", "failure"} {
+		sb.WriteString(fmt.Sprintf("config_reload_total{result=\"%s\"} %d\n", result, configReloads.results[result]))
+	}
+	sb.WriteString("\n")
+}
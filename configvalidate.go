@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// Check CONFIG_FILE and environment settings, then exit without serving
+	validateConfigOnly = flag.Bool("validate-config", false, "validate CONFIG_FILE and environment settings, then exit")
+	// ${VAR} and ${VAR:-default} references in the config file, $${ escapes a literal ${
+	configEnvPattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+	// Environment variables that held invalid values and fell back to their defaults
+	envErrors struct {
+		mutex sync.Mutex
+		list  []error
+	}
+)
+
+// recordEnvError notes an environment variable that could not be parsed
+func recordEnvError(err error) {
+	envErrors.mutex.Lock()
+	defer envErrors.mutex.Unlock()
+	envErrors.list = append(envErrors.list, err)
+}
+
+// expandConfigEnv replaces ${VAR} references with the JSON-escaped value of the variable, so
+// secrets and per-environment values can be kept out of the file. Unset variables without
+// a default are reported with their line number.
+func expandConfigEnv(data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	var errs []error
+	last := 0
+	for _, m := range configEnvPattern.FindAllSubmatchIndex(data, -1) {
+		out.Write(data[last:m[0]])
+		last = m[1]
+		ref := data[m[0]:m[1]]
+		if bytes.HasPrefix(ref, []byte("$$")) {
+			out.Write(ref[1:])
+			continue
+		}
+
+		name := string(data[m[2]:m[3]])
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			if m[4] < 0 {
+				line, column := offsetPosition(data, int64(m[0]))
+				errs = append(errs, fmt.Errorf("line %d, column %d: %s is not set", line, column, name))
+				continue
+			}
+			value = string(data[m[4]+len(":-") : m[5]])
+		}
+		quoted, _ := json.Marshal(value)
+		out.Write(quoted[1 : len(quoted)-1])
+	}
+	out.Write(data[last:])
+	return out.Bytes(), errors.Join(errs...)
+}
+
+// offsetPosition converts a byte offset into a 1-based line and column
+func offsetPosition(data []byte, offset int64) (line, column int) {
+	offset = min(max(offset, 0), int64(len(data)))
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// describeJSONError adds the position of syntax and type errors
+func describeJSONError(data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line, column := offsetPosition(data, syntaxErr.Offset)
+		return fmt.Errorf("line %d, column %d: %v", line, column, syntaxErr)
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		line, column := offsetPosition(data, typeErr.Offset)
+		return fmt.Errorf("line %d, column %d: %v", line, column, typeErr)
+	}
+	return err
+}
+
+// checkUnknownKeys walks a decoded document against the config types and reports keys
+// that would otherwise be silently ignored, with their full path
+func checkUnknownKeys(value any, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeFor[json.RawMessage]() {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		for _, key := range sortedKeys(object) {
+			field, ok := fields[key]
+			if !ok {
+				return fmt.Errorf("%s: unknown key %q", strings.TrimPrefix(path+"."+key, "."), key)
+			}
+			if err := checkUnknownKeys(object[key], field, strings.TrimPrefix(path+"."+key, ".")); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		for _, key := range sortedKeys(object) {
+			if err := checkUnknownKeys(object[key], t.Elem(), fmt.Sprintf("%s[%q]", path, key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		list, ok := value.([]any)
+		if !ok {
+			return nil
+		}
+		for i, item := range list {
+			if err := checkUnknownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of an object in order, so the first problem reported is stable
+func sortedKeys[V any](object map[string]V) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// envError joins the recorded environment problems, nil when there are none
+func envError() error {
+	envErrors.mutex.Lock()
+	defer envErrors.mutex.Unlock()
+	return errors.Join(envErrors.list...)
+}
+
+// runValidateConfig reports problems with the environment settings and returns the process
+// exit code. CONFIG_FILE itself was already loaded during initialization, which exits on errors.
+func runValidateConfig() int {
+	envErrors.mutex.Lock()
+	defer envErrors.mutex.Unlock()
+
+	for _, err := range envErrors.list {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(envErrors.list) > 0 {
+		fmt.Fprintf(os.Stderr, "Configuration is invalid: %d problem(s)\n", len(envErrors.list))
+		return 1
+	}
+	if configFile == "" {
+		fmt.Println("Configuration is valid (no CONFIG_FILE)")
+	} else {
+		fmt.Printf("Configuration is valid (CONFIG_FILE=%s)\n", configFile)
+	}
+	return 0
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Maximum concurrent connections from one client IP, 0 disables the limit. Behind a load
+	// balancer every connection comes from its address, so the limit must allow for that.
+	maxConnsPerClient = getEnvInt64("MAX_CONNS_PER_CLIENT", 0)
+	// Open connections by client IP
+	clientConns = struct {
+		mutex  sync.Mutex
+		counts map[string]int64
+	}{counts: make(map[string]int64)}
+	// Connections closed on accept because their client was over the limit
+	rejectedConns atomic.Int64
+	// Last time a rejection was logged, so a flood does not flood the log as well
+	lastRejectLog atomic.Int64
+)
+
+// clientLimitListener closes connections from clients that already hold maxConnsPerClient
+// connections, before any TLS or HTTP work is done for them
+type clientLimitListener struct {
+	net.Listener
+}
+
+// limitConnsPerClient wraps a listener with the per-client limit when it is enabled
+func limitConnsPerClient(ln net.Listener) net.Listener {
+	if maxConnsPerClient <= 0 {
+		return ln
+	}
+	return &clientLimitListener{Listener: ln}
+}
+
+// Accept returns the next connection within the limit, closing excess ones as they arrive
+func (l *clientLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		client := conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+
+		clientConns.mutex.Lock()
+		admitted := clientConns.counts[client] < maxConnsPerClient
+		if admitted {
+			clientConns.counts[client]++
+		}
+		clientConns.mutex.Unlock()
+
+		if admitted {
+			return &clientLimitConn{Conn: conn, client: client}, nil
+		}
+
+		conn.Close()
+		rejectedConns.Add(1)
+		if now := time.Now().Unix(); lastRejectLog.Swap(now) != now {
+			log.Printf("Rejected connection from %s, it already holds %d connections", client, maxConnsPerClient)
+		}
+	}
+}
+
+// clientLimitConn releases its client's slot when closed
+type clientLimitConn struct {
+	net.Conn
+	client string
+	once   sync.Once
+}
+
+// Close closes the connection and releases the slot once
+func (c *clientLimitConn) Close() error {
+	c.once.Do(func() {
+		clientConns.mutex.Lock()
+		defer clientConns.mutex.Unlock()
+		if clientConns.counts[c.client]--; clientConns.counts[c.client] <= 0 {
+			delete(clientConns.counts, c.client)
+		}
+	})
+	return c.Conn.Close()
+}
+
+// writeConnLimitMetrics appends per-client connection limit metrics in Prometheus format
+func writeConnLimitMetrics(sb *strings.Builder) {
+	if maxConnsPerClient <= 0 {
+		return
+	}
+
+	clientConns.mutex.Lock()
+	clients := len(clientConns.counts)
+	clientConns.mutex.Unlock()
+
+	sb.WriteString("# HELP http_connection_clients Client IPs with open connections\n")
+	sb.WriteString("# TYPE http_connection_clients gauge\n")
+	sb.WriteString(fmt.Sprintf("http_connection_clients %d\n", clients))
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP http_connections_rejected_total Connections closed because their client reached MAX_CONNS_PER_CLIENT\n")
+	sb.WriteString("# TYPE http_connections_rejected_total counter\n")
+	sb.WriteString(fmt.Sprintf("http_connections_rejected_total %d\n", rejectedConns.Load()))
+	sb.WriteString("\n")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// How long shutdown waits for open connections, keep it below terminationGracePeriodSeconds
+	shutdownTimeout = getEnvDuration("SHUTDOWN_TIMEOUT", 25*time.Second)
+	// Number of client connections currently open
+	openConnections atomic.Int64
+	// Last known state of every open client connection
+	connStates = struct {
+		mutex sync.Mutex
+		conns map[net.Conn]http.ConnState
+	}{conns: make(map[net.Conn]http.ConnState)}
+)
+
+// TrackConnState keeps openConnections and the per-state counts up to date from http.Server.ConnState.
+// Hijacked connections, the HTTP/2 cleartext connections taken over by the gRPC passthrough,
+// stay tracked until they are closed, see untrackConn. Reports for connections that never
+// were new, such as the HTTP/2 server's wrappers of those, are ignored.
+func TrackConnState(c net.Conn, state http.ConnState) {
+	connStates.mutex.Lock()
+	defer connStates.mutex.Unlock()
+
+	if _, tracked := connStates.conns[c]; !tracked && state != http.StateNew {
+		return
+	}
+	switch state {
+	case http.StateNew:
+		openConnections.Add(1)
+		connStates.conns[c] = state
+	case http.StateClosed:
+		openConnections.Add(-1)
+		delete(connStates.conns, c)
+	default:
+		connStates.conns[c] = state
+	}
+}
+
+// untrackConn forgets a hijacked connection once it is closed, net/http no longer reports it
+func untrackConn(c net.Conn) {
+	connStates.mutex.Lock()
+	defer connStates.mutex.Unlock()
+	if connStates.conns[c] == http.StateHijacked {
+		delete(connStates.conns, c)
+		openConnections.Add(-1)
+	}
+}
+
+// connectionCounts returns the number of open connections by state
+func connectionCounts() map[http.ConnState]int {
+	connStates.mutex.Lock()
+	defer connStates.mutex.Unlock()
+
+	counts := map[http.ConnState]int{http.StateNew: 0, http.StateActive: 0, http.StateIdle: 0}
+	for _, state := range connStates.conns {
+		// Hijacked connections serve HTTP/2 streams until they are closed
+		if state == http.StateHijacked {
+			state = http.StateActive
+		}
+		counts[state]++
+	}
+	return counts
+}
+
+// writeConnectionMetrics appends open connection gauges by state in Prometheus format
+func writeConnectionMetrics(sb *strings.Builder) {
+	counts := connectionCounts()
+	sb.WriteString("# HELP http_connections Open client connections by state\n")
+	sb.WriteString("# TYPE http_connections gauge\n")
+	for _, state := range []http.ConnState{http.StateNew, http.StateActive, http.StateIdle} {
+		sb.WriteString(fmt.Sprintf("http_connections{state=\"%s\"} %d\n", state, counts[state]))
+	}
+	sb.WriteString("\n")
+}
+
+// drainServer stops accepting connections and waits up to timeout for open ones to finish,
+// logging how many remain every second so the termination grace period can be tuned
+func drainServer(server *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Shutdown(ctx)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			// Shutdown does not wait for hijacked connections, it only asks them to finish
+			if err == nil && connectionCounts()[http.StateActive] > 0 {
+				err = waitForHijackedConns(ctx)
+			}
+			counts := connectionCounts()
+			if err != nil {
+				log.Printf("Drain stopped after %s with %d active and %d idle connections still open: %v",
+					time.Since(start).Round(time.Millisecond), counts[http.StateActive], counts[http.StateIdle]+counts[http.StateNew], err)
+				return
+			}
+			log.Printf("Drained all connections in %s", time.Since(start).Round(time.Millisecond))
+			return
+		case <-ticker.C:
+			counts := connectionCounts()
+			log.Printf("Draining for %s: %d active and %d idle connections remain",
+				time.Since(start).Round(time.Second), counts[http.StateActive], counts[http.StateIdle]+counts[http.StateNew])
+		}
+	}
+}
+
+// waitForHijackedConns waits until the hijacked connections are closed or ctx is done
+func waitForHijackedConns(ctx context.Context) error {
+	poll := time.NewTicker(50 * time.Millisecond)
+	defer poll.Stop()
+	for connectionCounts()[http.StateActive] > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-poll.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Header clients use to state how long they are willing to wait, in milliseconds
+const requestTimeoutHeader = "X-Request-Timeout"
+
+// Upper bound for client-specified request deadlines
+var requestTimeoutMax time.Duration
+
+// Initialize request deadline settings from environment variables
+func init() {
+	requestTimeoutMax = getEnvDuration("REQUEST_TIMEOUT_MAX", 60*time.Second)
+}
+
+// clientRequestTimeout returns the deadline requested through X-Request-Timeout, capped at
+// REQUEST_TIMEOUT_MAX; zero means the client did not ask for one
+func clientRequestTimeout(r *http.Request) (time.Duration, error) {
+	value := r.Header.Get(requestTimeoutHeader)
+	if value == "" {
+		return 0, nil
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, fmt.Errorf("invalid %s header %q, expected a positive number of milliseconds", requestTimeoutHeader, value)
+	}
+	// Clamp before converting, a huge value would overflow into a negative duration
+	if ms > requestTimeoutMax.Milliseconds() {
+		return requestTimeoutMax, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
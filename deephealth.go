@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	// Timeout applied to each dependency check of the deep health endpoint
+	deepHealthTimeout time.Duration
+	// How long a deep health result is reused for
+	deepHealthCacheTTL time.Duration
+	// Coalesces concurrent deep health requests into one round of checks
+	deepHealthGroup singleflight.Group
+	// Last deep health result and when it expires
+	deepHealthCache struct {
+		mutex        sync.Mutex
+		dependencies []dependencyStatus
+		expires      time.Time
+	}
+	// Additional dependency checks registered by optional features
+	dependencyChecks   = make(map[string]func(ctx context.Context) error)
+	dependencyChecksMu sync.Mutex
+)
+
+// Initialize deep health settings from environment variables
+func init() {
+	deepHealthTimeout = getEnvDuration("DEEP_HEALTH_TIMEOUT", 5*time.Second)
+	deepHealthCacheTTL = getEnvDuration("DEEP_HEALTH_CACHE_TTL", 5*time.Second)
+}
+
+// registerDependencyCheck adds a named check to the deep health endpoint
+func registerDependencyCheck(name string, check func(ctx context.Context) error) {
+	dependencyChecksMu.Lock()
+	defer dependencyChecksMu.Unlock()
+	dependencyChecks[name] = check
+}
+
+// dependencyStatus is the result of a single dependency check
+type dependencyStatus struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// deepHealthResponse is the body returned by the deep health endpoint
+type deepHealthResponse struct {
+	Status       string             `json:"status"`
+	Dependencies []dependencyStatus `json:"dependencies"`
+}
+
+// cachedDependencies returns the result of the last round of checks while it is fresh.
+// Otherwise concurrent callers share a single round, so the endpoint cannot be used to
+// flood the backends and dependencies with checks.
+func cachedDependencies() []dependencyStatus {
+	deepHealthCache.mutex.Lock()
+	if time.Now().Before(deepHealthCache.expires) {
+		dependencies := deepHealthCache.dependencies
+		deepHealthCache.mutex.Unlock()
+		return dependencies
+	}
+	deepHealthCache.mutex.Unlock()
+
+	result, _, _ := deepHealthGroup.Do("deep", func() (any, error) {
+		// Shared checks must not depend on the context of whichever request triggered them
+		dependencies := checkDependencies(context.Background())
+
+		deepHealthCache.mutex.Lock()
+		deepHealthCache.dependencies = dependencies
+		deepHealthCache.expires = time.Now().Add(deepHealthCacheTTL)
+		deepHealthCache.mutex.Unlock()
+
+		return dependencies, nil
+	})
+	return result.([]dependencyStatus)
+}
+
+// checkDependencies runs all dependency checks concurrently
+func checkDependencies(ctx context.Context) []dependencyStatus {
+	// Every backend instance is checked alongside the registered dependencies
+	checks := make(map[string]func(ctx context.Context) error)
+	for _, b := range backends.backends {
+		url := b.url
+		checks["backend:"+url] = func(ctx context.Context) error {
+			return probeBackend(ctx, url, deepHealthTimeout)
+		}
+	}
+	dependencyChecksMu.Lock()
+	for name, check := range dependencyChecks {
+		checks[name] = check
+	}
+	dependencyChecksMu.Unlock()
+
+	results := make([]dependencyStatus, 0, len(checks))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, deepHealthTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(checkCtx)
+			result := dependencyStatus{
+				Name:      name,
+				Status:    "UP",
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = "DOWN"
+				result.Error = err.Error()
+			}
+
+			mutex.Lock()
+			results = append(results, result)
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results
+}
+
+// DeepHealthHandler actively checks all dependencies and reports their status
+func DeepHealthHandler(w http.ResponseWriter, r *http.Request) {
+	// Only process requests for exact "/health/deep" path
+	if r.URL.Path != "/health/deep" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	response := deepHealthResponse{Status: "UP", Dependencies: cachedDependencies()}
+	for _, dep := range response.Dependencies {
+		if dep.Status != "UP" {
+			response.Status = "DOWN"
+		}
+	}
+
+	status := http.StatusOK
+	if response.Status != "UP" {
+		status = http.StatusServiceUnavailable
+	}
+	writeResponse(w, r, status, response)
+}
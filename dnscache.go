@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Cache of backend host lookups, nil when DNS_CACHE_TTL is unset
+var dnsCache *hostCache
+
+// Initialize DNS cache settings from environment variables
+func init() {
+	if ttl := getEnvDuration("DNS_CACHE_TTL", 0); ttl > 0 {
+		dnsCache = newHostCache(ttl, getEnvDuration("DNS_CACHE_NEGATIVE_TTL", 5*time.Second))
+	}
+}
+
+// hostEntry is a cached lookup result, failures are cached too
+type hostEntry struct {
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+// hostStats aggregates resolver activity for a host
+type hostStats struct {
+	lookups  int64
+	failures int64
+	hits     int64
+	seconds  float64
+}
+
+// hostCache resolves host names through net.DefaultResolver and keeps the answers for a TTL
+type hostCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	group       singleflight.Group
+	mutex       sync.Mutex
+	entries     map[string]hostEntry
+	stats       map[string]*hostStats
+}
+
+// newHostCache creates an empty cache
+func newHostCache(ttl, negativeTTL time.Duration) *hostCache {
+	return &hostCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]hostEntry),
+		stats:       make(map[string]*hostStats),
+	}
+}
+
+// statsFor returns the counters of a host, the caller must hold the mutex
+func (c *hostCache) statsFor(host string) *hostStats {
+	s, ok := c.stats[host]
+	if !ok {
+		s = &hostStats{}
+		c.stats[host] = s
+	}
+	return s
+}
+
+// lookup returns the addresses of a host from the cache or the resolver.
+// Concurrent misses for the same host share one resolver query.
+func (c *hostCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mutex.Lock()
+	if entry, ok := c.entries[host]; ok && time.Now().Before(entry.expires) {
+		c.statsFor(host).hits++
+		c.mutex.Unlock()
+		return entry.addrs, entry.err
+	}
+	c.mutex.Unlock()
+
+	result, err, _ := c.group.Do(host, func() (any, error) {
+		// The query is shared, so it must not be cancelled by whichever request started it
+		lookupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+
+		start := time.Now()
+		addrs, err := net.DefaultResolver.LookupHost(lookupCtx, host)
+		elapsed := time.Since(start)
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		s := c.statsFor(host)
+		s.lookups++
+		s.seconds += elapsed.Seconds()
+		ttl := c.ttl
+		if err != nil {
+			s.failures++
+			ttl = c.negativeTTL
+		}
+		if ttl > 0 {
+			c.entries[host] = hostEntry{addrs: addrs, err: err, expires: time.Now().Add(ttl)}
+		}
+		return addrs, err
+	})
+	addrs, _ := result.([]string)
+	return addrs, err
+}
+
+// flush drops the cached entry of a host, or every entry when host is empty
+func (c *hostCache) flush(host string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if host != "" {
+		if _, ok := c.entries[host]; !ok {
+			return 0
+		}
+		delete(c.entries, host)
+		return 1
+	}
+	flushed := len(c.entries)
+	c.entries = make(map[string]hostEntry)
+	return flushed
+}
+
+// dialContext resolves the host through the cache and tries each address in turn
+func (c *hostCache) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var lastErr error
+		for _, ip := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, lastErr
+	}
+}
+
+// writeMetrics appends DNS cache and lookup metrics in Prometheus format
+func (c *hostCache) writeMetrics(sb *strings.Builder) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	hosts := make([]string, 0, len(c.stats))
+	for host := range c.stats {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	sb.WriteString("# HELP dns_cache_hits_total Backend host lookups answered from the DNS cache\n")
+	sb.WriteString("# TYPE dns_cache_hits_total counter\n")
+	for _, host := range hosts {
+		sb.WriteString(fmt.Sprintf("dns_cache_hits_total{host=\"%s\"} %d\n", host, c.stats[host].hits))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP dns_lookup_failures_total Backend host lookups that failed at the resolver\n")
+	sb.WriteString("# TYPE dns_lookup_failures_total counter\n")
+	for _, host := range hosts {
+		sb.WriteString(fmt.Sprintf("dns_lookup_failures_total{host=\"%s\"} %d\n", host, c.stats[host].failures))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP dns_lookup_duration_seconds Time spent in resolver lookups for backend hosts\n")
+	sb.WriteString("# TYPE dns_lookup_duration_seconds summary\n")
+	for _, host := range hosts {
+		s := c.stats[host]
+		sb.WriteString(fmt.Sprintf("dns_lookup_duration_seconds_sum{host=\"%s\"} %.6f\n", host, s.seconds))
+		sb.WriteString(fmt.Sprintf("dns_lookup_duration_seconds_count{host=\"%s\"} %d\n", host, s.lookups))
+	}
+	sb.WriteString("\n")
+}
+
+// dnsFlushResponse is the body of /debug/dns/flush
+type dnsFlushResponse struct {
+	Flushed int `json:"flushed"`
+}
+
+// DNSFlushHandler drops cached lookups so the next backend request queries the resolver.
+// The optional "host" query parameter limits the flush to a single host.
+func DNSFlushHandler(w http.ResponseWriter, r *http.Request) {
+	// Only process requests for exact "/debug/dns/flush" path
+	if r.URL.Path != "/debug/dns/flush" {
+		NotFoundHandler(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, r, http.StatusMethodNotAllowed, "Use POST to flush the DNS cache")
+		return
+	}
+	if dnsCache == nil {
+		writeError(w, r, http.StatusConflict, "DNS cache is disabled, set DNS_CACHE_TTL to enable it")
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, dnsFlushResponse{Flushed: dnsCache.flush(r.URL.Query().Get("host"))})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+var (
+	// Skip the backend call and answer with a canned response
+	dryRunEnabled bool
+	// Status code of the canned response
+	dryRunStatus int
+	// Body of the canned response
+	dryRunBody string
+	// Content type of the canned response
+	dryRunContentType string
+)
+
+// Initialize dry-run settings from environment variables
+func init() {
+	dryRunEnabled = lookupSetting("DRY_RUN") == "true"
+	dryRunStatus = int(getEnvInt64("DRY_RUN_STATUS", http.StatusOK))
+	// WriteHeader panics on codes outside 100-999, which would fail every request
+	if dryRunStatus < 100 || dryRunStatus > 999 {
+		log.Printf("Invalid DRY_RUN_STATUS=%d, using %d", dryRunStatus, http.StatusOK)
+		recordEnvError(fmt.Errorf("DRY_RUN_STATUS=%d is not a valid status code, expected 100-999", dryRunStatus))
+		dryRunStatus = http.StatusOK
+	}
+	dryRunBody = getEnv("DRY_RUN_BODY", `{"status":"dry-run"}`)
+	dryRunContentType = getEnv("DRY_RUN_CONTENT_TYPE", "application/json")
+}
+
+// writeDryRunResponse answers a request that passed all middleware without contacting the backend
+func writeDryRunResponse(w http.ResponseWriter, r *http.Request) {
+	// Consume the body like a real backend would
+	io.Copy(io.Discard, r.Body)
+
+	w.Header().Set("Content-Type", dryRunContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(dryRunBody)))
+	w.Header().Set("X-Dry-Run", "true")
+	w.WriteHeader(dryRunStatus)
+	io.WriteString(w, dryRunBody)
+}
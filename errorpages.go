@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Built-in error page templates, overridable through ERROR_TEMPLATE_DIR.
+// JSON errors follow RFC 7807 problem details.
+const (
+	defaultErrorJSONTemplate = `{"type":{{json .Type}},"title":{{json .StatusText}},"status":{{.Status}},"detail":{{json .Message}},"instance":{{json .Path}},"request_id":{{json .RequestID}},"timestamp":{{json .Timestamp}}}`
+	defaultErrorHTMLTemplate = `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+<p><small>Path: {{.Path}} &middot; Request ID: {{.RequestID}} &middot; {{.Timestamp}}</small></p>
+</body>
+</html>
+`
+)
+
+var (
+	// Error page templates keyed by "<status>.<format>" or "error.<format>"
+	errorTemplates = make(map[string]interface {
+		Execute(io.Writer, any) error
+	})
+	// Base URL for problem type URIs, "about:blank" is used when empty
+	problemTypeBaseURL = strings.TrimSuffix(lookupSetting("PROBLEM_TYPE_BASE_URL"), "/")
+	// Functions available to JSON error templates
+	errorTemplateFuncs = texttemplate.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}
+)
+
+// errorPageData is passed to error page templates
+type errorPageData struct {
+	Type       string
+	Status     int
+	StatusText string
+	Message    string // Problem detail
+	Method     string
+	Path       string // Problem instance
+	RequestID  string
+	Timestamp  string
+}
+
+// Initialize error page templates.
+// ERROR_TEMPLATE_DIR may contain <status>.json.tmpl, <status>.html.tmpl, error.json.tmpl and error.html.tmpl
+// files; files without template actions are served as static pages.
+func init() {
+	errorTemplates["error.json"] = texttemplate.Must(texttemplate.New("error.json").Funcs(errorTemplateFuncs).Parse(defaultErrorJSONTemplate))
+	errorTemplates["error.html"] = htmltemplate.Must(htmltemplate.New("error.html").Parse(defaultErrorHTMLTemplate))
+
+	dir := lookupSetting("ERROR_TEMPLATE_DIR")
+	if dir == "" {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		log.Fatalf("Invalid ERROR_TEMPLATE_DIR=%q: %v", dir, err)
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".tmpl")
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatalf("Failed to read error template %s: %v", file, err)
+		}
+
+		switch filepath.Ext(name) {
+		case ".json":
+			tmpl, err := texttemplate.New(name).Funcs(errorTemplateFuncs).Parse(string(data))
+			if err != nil {
+				log.Fatalf("Failed to parse error template %s: %v", file, err)
+			}
+			errorTemplates[name] = tmpl
+		case ".html":
+			tmpl, err := htmltemplate.New(name).Parse(string(data))
+			if err != nil {
+				log.Fatalf("Failed to parse error template %s: %v", file, err)
+			}
+			errorTemplates[name] = tmpl
+		default:
+			log.Printf("Ignoring error template %s, expected .json.tmpl or .html.tmpl", file)
+			continue
+		}
+		log.Printf("Loaded error template %s", file)
+	}
+}
+
+// prefersHTML reports whether the client weighs HTML above JSON in its Accept header
+func prefersHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	html := max(acceptQuality(accept, "text/html"), acceptQuality(accept, "application/xhtml+xml"))
+	json := max(acceptQuality(accept, "application/problem+json"), acceptQuality(accept, "application/json"))
+	return html > json
+}
+
+// writeError renders an error response using the template for its status and the negotiated format
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	data := errorPageData{
+		Type:       "about:blank",
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RequestID:  requestIDFromContext(r.Context()),
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if problemTypeBaseURL != "" {
+		data.Type = problemTypeBaseURL + "/" + strconv.Itoa(status)
+	}
+
+	format, contentType := "json", "application/problem+json"
+	if prefersHTML(r) {
+		format, contentType = "html", "text/html; charset=utf-8"
+	}
+	tmpl, ok := errorTemplates[strconv.Itoa(status)+"."+format]
+	if !ok {
+		tmpl = errorTemplates["error."+format]
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		log.Printf("Error rendering error template for status %d: %v", status, err)
+		buf.Reset()
+		contentType = "application/problem+json"
+		errorTemplates["error.json"].Execute(&buf, data)
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+var (
+	// gRPC upstream receiving requests with an application/grpc content type, empty disables passthrough
+	grpcBackendURL string
+	// HTTP/2 client for the gRPC upstream
+	grpcClient *http.Client
+	// Serves the HTTP/2 cleartext connections grpcPassthrough takes over
+	h2cServer = &http2.Server{}
+)
+
+// gRPC status codes used when the proxy itself answers
+const (
+	grpcStatusDeadlineExceeded = 4
+	grpcStatusInternal         = 13
+	grpcStatusUnavailable      = 14
+)
+
+// Initialize gRPC passthrough settings from environment variables
+func init() {
+	grpcBackendURL = strings.TrimSuffix(lookupSetting("GRPC_BACKEND"), "/")
+	if grpcBackendURL == "" {
+		return
+	}
+	u, err := url.Parse(grpcBackendURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Fatalf("Invalid GRPC_BACKEND=%q, expected an http:// (h2c) or https:// URL", grpcBackendURL)
+	}
+
+	// The client gets the settings of backend requests: the per-backend TLS settings of
+	// CONFIG_FILE, the forward proxy, the DNS cache and the upstream credentials
+	tlsConfig := &tls.Config{NextProtos: []string{"h2"}}
+	if bc, ok := backendConfigFor(grpcBackendURL); ok {
+		if err := bc.applyTLS(tlsConfig); err != nil {
+			log.Fatalf("Invalid backend settings for GRPC_BACKEND=%q: %v", grpcBackendURL, err)
+		}
+	}
+	var dialer net.Dialer
+	dial := dialer.DialContext
+	if dnsCache != nil {
+		dial = dnsCache.dialContext(dial)
+	}
+	transport := &http2.Transport{
+		// Plain text upstreams speak HTTP/2 with prior knowledge (h2c)
+		AllowHTTP:       u.Scheme == "http",
+		TLSClientConfig: tlsConfig,
+		DialTLSContext: func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+			conn, err := dialGRPCBackend(ctx, dial, u.Scheme, addr)
+			if err != nil || u.Scheme == "http" {
+				return conn, err
+			}
+			tlsConn := tls.Client(conn, config)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+	}
+	// Token endpoints speak HTTP/1.1, they are reached like other backend hosts
+	tokenTransport := http.DefaultTransport.(*http.Transport).Clone()
+	tokenTransport.Proxy = backendProxy
+	roundTripper, err := newBackendAuthTransport(transport, tokenTransport)
+	if err != nil {
+		log.Fatalf("Invalid backend credentials: %v", err)
+	}
+	grpcClient = &http.Client{Transport: roundTripper}
+}
+
+// dialGRPCBackend connects to the gRPC upstream, through a tunnel when a forward proxy is
+// selected for it, since HTTP/2 cannot be sent to a proxy as plain requests
+func dialGRPCBackend(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), scheme, addr string) (net.Conn, error) {
+	proxyURL, err := backendProxy(&http.Request{URL: &url.URL{Scheme: scheme, Host: addr}})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return dial(ctx, "tcp", addr)
+	}
+	if proxyURL.Scheme != "http" {
+		return nil, fmt.Errorf("gRPC calls can only be tunneled through http:// proxies, not %s", proxyURL.Redacted())
+	}
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	connect := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		connect.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := connect.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, connect)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused the tunnel to %s: %s", proxyURL.Redacted(), addr, resp.Status)
+	}
+	// The upstream may already have sent its HTTP/2 settings along with the proxy response
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn is a connection whose first bytes were read into a buffer
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read returns the buffered bytes before reading from the connection
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// isGRPCRequest reports whether a request carries gRPC traffic
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcPassthrough sends gRPC requests to GRPC_BACKEND and everything else to next. It also
+// accepts HTTP/2 over plain text (h2c), which gRPC clients use without TLS.
+func grpcPassthrough(next http.Handler) http.Handler {
+	if grpcBackendURL == "" {
+		return next
+	}
+	// gRPC calls are proxied traffic and pass the same middlewares as the "/" route
+	recovery := Skippable("recovery", RecoveryMiddleware)
+	tarpit := Skippable("tarpit", TarpitMiddleware)
+	concurrency := Skippable("concurrency", ConcurrencyLimitMiddleware)
+	signature := Skippable("signature", SignatureMiddleware)
+	multipart := Skippable("multipart", MultipartMiddleware)
+	throttle := Skippable("throttle", ThrottleMiddleware)
+	grpc := AccessLogMiddleware(recovery(tarpit(concurrency(signature(multipart(throttle(GRPCHandler)))))))
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isGRPCRequest(r) {
+			grpc(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	return h2c.NewHandler(handler, h2cServer)
+}
+
+// configureH2C lets server shut down the HTTP/2 cleartext connections handed over to h2cServer
+// gracefully, once taken over they are no longer part of its own shutdown
+func configureH2C(server *http.Server) error {
+	if grpcBackendURL == "" {
+		return nil
+	}
+	return http2.ConfigureServer(server, h2cServer)
+}
+
+// writeGRPCStatus answers a gRPC call with an error status in a trailers-only response
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", url.PathEscape(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// GRPCHandler proxies a gRPC call to GRPC_BACKEND, streaming both directions and passing
+// trailers, which carry the call status, back to the client
+func GRPCHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, grpcBackendURL+r.URL.RequestURI(), r.Body)
+	if err != nil {
+		writeGRPCStatus(w, grpcStatusInternal, err.Error())
+		return
+	}
+	for name, values := range r.Header {
+		req.Header[name] = values
+	}
+	getConfig().route(r.URL.Path).stripAuth(req.Header)
+	req.Header.Del(syntheticProbeTokenHeader)
+	req.ContentLength = r.ContentLength
+	req.Trailer = r.Trailer
+	req.Header.Del("Trailer")
+	// gRPC upstreams reject calls that do not declare trailer support
+	req.Header.Set("Te", "trailers")
+
+	resp, err := grpcClient.Do(req)
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeGRPCStatus(w, grpcStatusDeadlineExceeded, err.Error())
+		return
+	}
+	if err != nil {
+		writeGRPCStatus(w, grpcStatusUnavailable, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	announced := announceTrailers(w, resp)
+	w.WriteHeader(resp.StatusCode)
+
+	// Forward every message as soon as it arrives so streaming calls keep their flow control
+	if _, err := streamResponseBody(w, resp.Body, true); err != nil {
+		log.Printf("Error copying gRPC response: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+	copyTrailers(w, resp, announced)
+}
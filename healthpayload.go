@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Fields the liveness and readiness endpoints report, in the order they are written
+var healthPayloadKeys = []string{"status", "uptime", "backend", "error"}
+
+// healthConfig is the "health" section of CONFIG_FILE. It shapes the bodies of /health/live
+// and /health/ready to match the contract of an external monitoring system, status codes
+// are not affected.
+type healthConfig struct {
+	Fields map[string]json.RawMessage `json:"fields"` // Static fields added to every body, e.g. region or zone
+	Status map[string]string          `json:"status"` // Words reported instead of UP and DOWN
+	Keys   map[string]string          `json:"keys"`   // Names used instead of the built-in keys, "" omits the field
+}
+
+// validate checks the status vocabulary and that no two fields end up with the same name
+func (hc *healthConfig) validate() error {
+	for _, status := range sortedKeys(hc.Status) {
+		if status != "UP" && status != "DOWN" {
+			return fmt.Errorf("status: unknown status %q, expected UP or DOWN", status)
+		}
+		if hc.Status[status] == "" {
+			return fmt.Errorf("status: %s needs a replacement word", status)
+		}
+	}
+
+	for _, key := range sortedKeys(hc.Keys) {
+		if !slices.Contains(healthPayloadKeys, key) {
+			return fmt.Errorf("keys: unknown key %q, expected one of %s", key, strings.Join(healthPayloadKeys, ", "))
+		}
+	}
+	names := make(map[string]string)
+	for _, key := range healthPayloadKeys {
+		name := hc.key(key)
+		if name == "" {
+			continue
+		}
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("keys: %s and %s are both named %q", other, key, name)
+		}
+		names[name] = key
+	}
+	for _, name := range sortedKeys(hc.Fields) {
+		if key, ok := names[name]; ok {
+			return fmt.Errorf("fields: %q is already used by the %s field", name, key)
+		}
+		if !json.Valid(hc.Fields[name]) {
+			return fmt.Errorf("fields[%q]: invalid JSON value", name)
+		}
+	}
+	return nil
+}
+
+// key returns the name a built-in field is written under
+func (hc *healthConfig) key(key string) string {
+	if name, ok := hc.Keys[key]; ok {
+		return name
+	}
+	return key
+}
+
+// healthField is one field of a health body
+type healthField struct {
+	key   string
+	value any
+}
+
+// healthPayload is a health body that keeps its fields in order, built-in ones first
+type healthPayload []healthField
+
+// livenessResponse is the body of /health/live
+type livenessResponse struct {
+	Status string `json:"status"`
+	Uptime string `json:"uptime"`
+}
+
+// readinessResponse is the body of /health/ready
+type readinessResponse struct {
+	Status  string `json:"status"`
+	Backend string `json:"backend"`
+	Error   string `json:"error,omitempty"`
+}
+
+// newHealthPayload turns a health response into its configured form: built-in fields are
+// renamed, the status is translated and the static fields of the "health" section of
+// CONFIG_FILE are appended
+func newHealthPayload(response any) healthPayload {
+	hc := getConfig().Health
+	v := reflect.ValueOf(response)
+	payload := make(healthPayload, 0, v.NumField()+len(hc.Fields))
+	for i := 0; i < v.NumField(); i++ {
+		name, options, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if options == "omitempty" && v.Field(i).IsZero() {
+			continue
+		}
+		field := healthField{key: name, value: v.Field(i).Interface()}
+		if field.key == "status" {
+			if word, ok := hc.Status[field.value.(string)]; ok {
+				field.value = word
+			}
+		}
+		if field.key = hc.key(field.key); field.key != "" {
+			payload = append(payload, field)
+		}
+	}
+	for _, name := range sortedKeys(hc.Fields) {
+		payload = append(payload, healthField{key: name, value: hc.Fields[name]})
+	}
+	return payload
+}
+
+// MarshalJSON writes the fields as an object in their order
+func (p healthPayload) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range p {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(field.key)
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, fmt.Errorf("health field %q: %w", field.key, err)
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
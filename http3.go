@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+var (
+	// UDP address of the optional HTTP/3 listener, e.g. ":8443"
+	http3Addr = lookupSetting("HTTP3_ADDR")
+	// Route groups served over HTTP/3, comma separated
+	http3Groups = getEnv("HTTP3_GROUPS", "proxy")
+)
+
+// http3Spec describes the QUIC listener like any other listener, so it only serves the route
+// groups of HTTP3_GROUPS. It shares the certificate of the first TLS listener, which is the one
+// of TLS_CERT_FILE and TLS_KEY_FILE unless CONFIG_FILE declares the listeners.
+func http3Spec(specs []listenerConfig) listenerConfig {
+	spec := listenerConfig{Address: http3Addr}
+	if i := slices.IndexFunc(specs, func(lc listenerConfig) bool { return lc.TLS != nil }); i >= 0 {
+		spec.TLS = specs[i].TLS
+	}
+	for _, group := range strings.Split(http3Groups, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			spec.Groups = append(spec.Groups, group)
+		}
+	}
+	return spec
+}
+
+// startHTTP3 runs the optional QUIC listener next to the TCP listeners of server and shuts it
+// down together with server. It returns the QUIC server, nil when HTTP/3 is not enabled.
+// Clients only find HTTP/3 through the Alt-Svc header of a TLS listener, so one is required.
+func startHTTP3(server *http.Server, specs []listenerConfig, errs chan<- error) *http3.Server {
+	if http3Addr == "" {
+		return nil
+	}
+	spec := http3Spec(specs)
+	if spec.TLS == nil {
+		log.Fatalf("HTTP3_ADDR requires a TLS listener to advertise it, set TLS_CERT_FILE and TLS_KEY_FILE or declare one in CONFIG_FILE")
+	}
+	if err := spec.validate(); err != nil {
+		log.Fatalf("Invalid HTTP/3 listener HTTP3_ADDR=%q HTTP3_GROUPS=%q: %v", http3Addr, http3Groups, err)
+	}
+
+	quicServer := &http3.Server{Addr: http3Addr, Handler: newRouter(spec)}
+	log.Printf("HTTP/3 server starting on %s (udp, %s)", http3Addr, strings.Join(spec.Groups, ", "))
+	go func() {
+		errs <- quicServer.ListenAndServeTLS(spec.TLS.CertFile, spec.TLS.KeyFile)
+	}()
+	server.RegisterOnShutdown(func() {
+		quicServer.Shutdown(context.Background())
+	})
+	return quicServer
+}
+
+// advertiseHTTP3 points clients of a TLS listener to the QUIC listener through the Alt-Svc
+// header. Plain HTTP listeners do not advertise it, HTTP/3 is only reachable over TLS.
+func advertiseHTTP3(quicServer *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fails only until the QUIC listener is up, the header is then simply omitted
+		quicServer.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
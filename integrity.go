@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var (
+	// Attach Digest and Content-SHA256 headers to proxied responses
+	responseDigestEnabled bool
+	// Verify digests provided by the backend before forwarding
+	verifyUpstreamDigest bool
+	// Largest body buffered to compute digests, RESPONSE_MAX_BYTES applies when it is lower
+	digestMaxBytes int64
+)
+
+// Initialize response integrity settings from environment variables
+func init() {
+	responseDigestEnabled = lookupSetting("RESPONSE_DIGEST") == "true"
+	verifyUpstreamDigest = lookupSetting("VERIFY_UPSTREAM_DIGEST") == "true"
+
+	// Digests need the whole body in memory, so they are never computed without a cap
+	digestMaxBytes = getEnvInt64("DIGEST_MAX_BYTES", 16<<20)
+	if digestMaxBytes <= 0 {
+		log.Printf("Invalid DIGEST_MAX_BYTES=%d, using 16MiB", digestMaxBytes)
+		recordEnvError(fmt.Errorf("DIGEST_MAX_BYTES=%d must be positive, digests always buffer the body", digestMaxBytes))
+		digestMaxBytes = 16 << 20
+	}
+}
+
+// checkResponseIntegrity verifies and attaches payload digests on a backend response.
+// It returns the reader the response body should be copied from.
+func checkResponseIntegrity(r *http.Request, resp *http.Response) (io.Reader, error) {
+	if !responseDigestEnabled && !verifyUpstreamDigest {
+		return resp.Body, nil
+	}
+
+	// Partial content and HEAD responses do not carry the full representation
+	if r.Method == http.MethodHead || resp.StatusCode == http.StatusPartialContent {
+		return resp.Body, nil
+	}
+
+	// Digests cover the whole payload, so the body has to be buffered up to the cap
+	limit := digestMaxBytes
+	if responseMaxBytes > 0 {
+		limit = min(limit, responseMaxBytes)
+	}
+	if resp.ContentLength > limit {
+		return nil, errResponseTooLarge
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading backend response: %w", err)
+	}
+	if int64(len(body)) > limit {
+		return nil, errResponseTooLarge
+	}
+	sum256 := sha256.Sum256(body)
+
+	if verifyUpstreamDigest {
+		if err := verifyDigestHeaders(resp.Header, body, sum256[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	if responseDigestEnabled {
+		resp.Header.Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum256[:]))
+		resp.Header.Set("Content-SHA256", hex.EncodeToString(sum256[:]))
+	}
+
+	return bytes.NewReader(body), nil
+}
+
+// verifyDigestHeaders compares the Digest, Content-Digest and Content-SHA256 headers against the body
+func verifyDigestHeaders(header http.Header, body, sum256 []byte) error {
+	// Content-SHA256 carries a hex encoded SHA-256
+	if value := header.Get("Content-SHA256"); value != "" {
+		if !strings.EqualFold(value, hex.EncodeToString(sum256)) {
+			return errors.New("Content-SHA256 mismatch")
+		}
+	}
+
+	// Digest (RFC 3230) uses alg=base64, Content-Digest (RFC 9530) uses alg=:base64:
+	for _, name := range []string{"Digest", "Content-Digest"} {
+		for _, entry := range strings.Split(header.Get(name), ",") {
+			algorithm, value, found := strings.Cut(strings.TrimSpace(entry), "=")
+			if !found {
+				continue
+			}
+			value = strings.Trim(value, ":")
+
+			var expected []byte
+			switch strings.ToLower(algorithm) {
+			case "sha-256":
+				expected = sum256
+			case "sha-512":
+				sum512 := sha512.Sum512(body)
+				expected = sum512[:]
+			default:
+				// Algorithms we cannot compute are ignored
+				continue
+			}
+			if value != base64.StdEncoding.EncodeToString(expected) {
+				return fmt.Errorf("%s %s mismatch", name, algorithm)
+			}
+		}
+	}
+	return nil
+}
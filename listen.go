@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// listenNetwork maps LISTEN_IP_VERSION (dual, ipv4, ipv6) to a network name for net.Listen
+func listenNetwork() (string, error) {
+	switch version := getEnv("LISTEN_IP_VERSION", "dual"); version {
+	case "dual":
+		return "tcp", nil
+	case "ipv4":
+		return "tcp4", nil
+	case "ipv6":
+		return "tcp6", nil
+	default:
+		return "", fmt.Errorf("unsupported LISTEN_IP_VERSION=%q, expected dual, ipv4 or ipv6", version)
+	}
+}
+
+// listenAddresses returns the addresses to serve on.
+// LISTEN_ADDRESSES takes a comma separated list of host:port pairs, otherwise LISTEN_HOST and PORT are combined.
+func listenAddresses(port string) []string {
+	var addresses []string
+	for _, entry := range strings.Split(lookupSetting("LISTEN_ADDRESSES"), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			addresses = append(addresses, entry)
+		}
+	}
+	if len(addresses) == 0 {
+		addresses = append(addresses, net.JoinHostPort(lookupSetting("LISTEN_HOST"), port))
+	}
+	return addresses
+}
+
+// openListeners binds the address of every listener in order, closing already opened ones on failure
+func openListeners(specs []listenerConfig) ([]net.Listener, error) {
+	network, err := listenNetwork()
+	if err != nil {
+		return nil, err
+	}
+
+	var listeners []net.Listener
+	for _, spec := range specs {
+		ln, err := net.Listen(network, spec.Address)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, limitConnsPerClient(ln))
+	}
+	return listeners, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+var (
+	// Route groups a listener can expose
+	routeGroups = []string{"proxy", "health", "info", "metrics", "admin"}
+	// Certificate and key of the listeners of PORT or LISTEN_ADDRESSES, which serve HTTPS when
+	// both are set. The HTTP/3 listener uses them as well.
+	tlsCertFile = lookupSetting("TLS_CERT_FILE")
+	tlsKeyFile  = lookupSetting("TLS_KEY_FILE")
+)
+
+// Initialize listener settings from environment variables
+func init() {
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		recordEnvError(errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+}
+
+// listenerConfig is one entry of the "listeners" section of CONFIG_FILE. Without the section
+// PORT or LISTEN_ADDRESSES are served with every route group, over HTTPS when TLS_CERT_FILE
+// and TLS_KEY_FILE are set.
+type listenerConfig struct {
+	Address string       `json:"address"` // host:port to bind, e.g. ":8443"
+	TLS     *listenerTLS `json:"tls"`     // Serve HTTPS with this certificate
+	Groups  []string     `json:"groups"`  // Route groups exposed, all when empty
+}
+
+// listenerTLS holds the certificate of an HTTPS listener
+type listenerTLS struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// validate checks the address, the route groups and that the certificate files exist
+func (lc *listenerConfig) validate() error {
+	if _, _, err := net.SplitHostPort(lc.Address); err != nil {
+		return fmt.Errorf("address: %w", err)
+	}
+	for _, group := range lc.Groups {
+		if !slices.Contains(routeGroups, group) {
+			return fmt.Errorf("unknown route group %q, expected one of %s", group, strings.Join(routeGroups, ", "))
+		}
+	}
+	if lc.TLS != nil {
+		if lc.TLS.CertFile == "" || lc.TLS.KeyFile == "" {
+			return errors.New("tls requires cert_file and key_file")
+		}
+		for _, file := range []string{lc.TLS.CertFile, lc.TLS.KeyFile} {
+			if _, err := os.Stat(file); err != nil {
+				return fmt.Errorf("tls: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// exposes reports whether the listener serves a route group
+func (lc *listenerConfig) exposes(group string) bool {
+	return len(lc.Groups) == 0 || slices.Contains(lc.Groups, group)
+}
+
+// listenerSpecs returns the listeners to open, from CONFIG_FILE or else from the environment
+func listenerSpecs(port string) []listenerConfig {
+	if specs := getConfig().Listeners; len(specs) > 0 {
+		return specs
+	}
+	var specs []listenerConfig
+	for _, addr := range listenAddresses(port) {
+		spec := listenerConfig{Address: addr}
+		if tlsCertFile != "" && tlsKeyFile != "" {
+			spec.TLS = &listenerTLS{CertFile: tlsCertFile, KeyFile: tlsKeyFile}
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// listenerHandlerKey is the connection context key holding the handler of the accepting listener
+type listenerHandlerKey struct{}
+
+// routedListener tags accepted connections with the handler of its route groups
+type routedListener struct {
+	net.Listener
+	handler http.Handler
+}
+
+// routedConn is a connection accepted by a routedListener
+type routedConn struct {
+	net.Conn
+	handler http.Handler
+}
+
+// Close closes the connection and stops tracking it if it was hijacked
+func (c *routedConn) Close() error {
+	err := c.Conn.Close()
+	untrackConn(c)
+	return err
+}
+
+// Accept returns the next connection tagged with the listener's handler
+func (l *routedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &routedConn{Conn: conn, handler: l.handler}, nil
+}
+
+// ListenerConnContext remembers which listener accepted a connection, looking through TLS
+func ListenerConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tlsConn, ok := c.(interface{ NetConn() net.Conn }); ok {
+		c = tlsConn.NetConn()
+	}
+	if rc, ok := c.(*routedConn); ok {
+		ctx = context.WithValue(ctx, listenerHandlerKey{}, rc.handler)
+	}
+	return ThrottleConnContext(ctx, c)
+}
+
+// dispatchByListener serves each request with the handler of the listener that accepted it.
+// Connections from other sources use fallback.
+func dispatchByListener(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler, ok := r.Context().Value(listenerHandlerKey{}).(http.Handler); ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
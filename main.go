@@ -1,18 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand/v2"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 var (
-	// Application version from environment variable with default
+	// Application version from build metadata, overridable by environment variable
 	version string
 	// Backend URL from environment variable with default
 	backendURL string
@@ -22,144 +33,425 @@ var (
 	accessLogger = log.New(os.Stdout, "ACCESS: ", log.LstdFlags)
 	// Metrics
 	metrics = NewMetrics()
+	// Shared HTTP client for backend requests
+	backendClient *http.Client
 )
 
 // Initialize environment variables with defaults
 func init() {
-	// Set VERSION with default "1.0.0"
-	version = os.Getenv("VERSION")
+	// Set VERSION with default from the version injected at build time
+	version = lookupSetting("VERSION")
 	if version == "" {
-		version = "1.0.0"
+		version = buildVersion
 	}
 
 	// Set BACKEND with default "http://localhost:8080/version"
-	backendURL = os.Getenv("BACKEND")
+	backendURL = lookupSetting("BACKEND")
 	if backendURL == "" {
 		backendURL = "http://localhost:8080/version"
+		// Use the built-in stub upstream when it is enabled
+		if mockBackendEnabled {
+			backendURL = mockBackendURL()
+		}
+	}
+
+	// Set BACKEND_TIMEOUT with default 10s, it bounds the wait for response headers
+	// only so that large bodies can stream for as long as they need
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = getEnvDuration("BACKEND_TIMEOUT", 10*time.Second)
+	// Pass payloads through untouched so Range offsets and lengths stay valid
+	transport.DisableCompression = true
+	// Route backend requests through a forward proxy when configured
+	transport.Proxy = backendProxy
+	// Resolve backend hosts through the DNS cache when enabled
+	if dnsCache != nil {
+		transport.DialContext = dnsCache.dialContext(transport.DialContext)
+	}
+	// Apply per-backend TLS and protocol overrides from CONFIG_FILE
+	roundTripper, err := newBackendTransport(transport, getConfig().Backends)
+	if err != nil {
+		log.Fatalf("Invalid backend settings in CONFIG_FILE=%s: %v", configFile, err)
+	}
+	// Attach upstream credentials so clients never hold them
+	roundTripper, err = newBackendAuthTransport(roundTripper, roundTripper)
+	if err != nil {
+		log.Fatalf("Invalid backend credentials: %v", err)
+	}
+	// Abort backend responses that stop sending body bytes
+	roundTripper = newStreamIdleTransport(roundTripper, streamIdleTimeout)
+	backendClient = &http.Client{Transport: roundTripper}
+
+	// BACKEND may hold a comma separated list of instances, balanced with optional
+	// active health checks and a slow-start ramp for recovered instances
+	backendURLs := parseBackendURLs(backendURL)
+	if len(backendURLs) == 0 {
+		recordEnvError(fmt.Errorf("BACKEND=%q holds no URL", backendURL))
+	}
+	for _, rawURL := range backendURLs {
+		if _, err := backendOrigin(rawURL); err != nil {
+			recordEnvError(fmt.Errorf("BACKEND entry %q is invalid: %w", rawURL, err))
+		}
+	}
+	backends = newBackendPool(backendURLs,
+		getEnvDuration("BACKEND_HEALTH_INTERVAL", 0),
+		getEnvDuration("BACKEND_SLOW_START", 0),
+	)
+}
+
+// Settings read from the environment by name, fingerprinted by configHash. Secrets and
+// per-instance values are read with os.Getenv so they stay out of it.
+var settings struct {
+	mutex  sync.Mutex
+	values map[string]string
+}
+
+// lookupSetting returns the value of an environment variable and remembers it as a setting
+func lookupSetting(key string) string {
+	value := os.Getenv(key)
+	settings.mutex.Lock()
+	defer settings.mutex.Unlock()
+	if settings.values == nil {
+		settings.values = make(map[string]string)
 	}
+	settings.values[key] = value
+	return value
+}
+
+// getEnv returns the value of an environment variable or the given default
+func getEnv(key, fallback string) string {
+	if value := lookupSetting(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvDuration parses a duration environment variable or returns the given default
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := lookupSetting(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s=%q, using default %s", key, value, fallback)
+		recordEnvError(fmt.Errorf("%s=%q is not a valid duration: %w", key, value, err))
+		return fallback
+	}
+	return d
+}
+
+// getEnvInt64 parses an integer environment variable or returns the given default
+func getEnvInt64(key string, fallback int64) int64 {
+	value := lookupSetting(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Printf("Invalid integer for %s=%q, using default %d", key, value, fallback)
+		recordEnvError(fmt.Errorf("%s=%q is not a valid integer: %w", key, value, err))
+		return fallback
+	}
+	return n
 }
 
 // Metrics tracks request statistics
 type Metrics struct {
-	mutex             sync.RWMutex
-	totalRequests     map[string]int64         // Counter for total requests by path
-	statusCodes       map[string]map[int]int64 // Counter for status codes by path
-	requestDurations  map[string][]float64     // Histogram data for request durations
-	appStartTimestamp int64                    // Timestamp when the application started
+	shards            []metricsShard // Request statistics spread over independently locked shards
+	appStartTimestamp int64          // Timestamp when the application started
+}
+
+// metricsShard holds a share of the request statistics. Every request records into a random
+// shard, so even a single busy path is spread over all of them and concurrent requests rarely
+// wait for the same lock. Readers merge the shards.
+type metricsShard struct {
+	mutex  sync.Mutex
+	paths  map[string]*pathMetrics // Counters and duration histogram by path
+	recent []requestSample         // Requests within the stats window, oldest first
+	slo    map[string]*sloCounters // Totals of routes with objectives by route
+	_      [64]byte                // Keeps the locks of neighbouring shards off one cache line
 }
 
-// NewMetrics creates a new Metrics instance
+// pathMetrics holds the series of one path, aggregated as requests are recorded
+type pathMetrics struct {
+	requests    int64             // Counter for total requests
+	statusCodes map[int]int64     // Counter for status codes
+	bytes       int64             // Counter for response body bytes
+	panics      int64             // Counter for recovered handler panics
+	durations   durationHistogram // Request duration histogram
+}
+
+// Upper bounds of the request duration histogram buckets in seconds
+var durationBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// durationHistogram counts observations per bucket, so exposition cost does not grow with traffic
+type durationHistogram struct {
+	counts [len(durationBuckets) + 1]int64 // Observations per bucket, not cumulative, the last one is +Inf
+	sum    float64
+	count  int64
+}
+
+// observe adds a duration in seconds to its bucket
+func (h *durationHistogram) observe(seconds float64) {
+	h.counts[sort.SearchFloat64s(durationBuckets[:], seconds)]++
+	h.sum += seconds
+	h.count++
+}
+
+// merge adds the series of another path to these
+func (pm *pathMetrics) merge(other *pathMetrics) {
+	pm.requests += other.requests
+	for code, count := range other.statusCodes {
+		pm.statusCodes[code] += count
+	}
+	pm.bytes += other.bytes
+	pm.panics += other.panics
+	for i, count := range other.durations.counts {
+		pm.durations.counts[i] += count
+	}
+	pm.durations.sum += other.durations.sum
+	pm.durations.count += other.durations.count
+}
+
+// NewMetrics creates a new Metrics instance with one shard per processor
 func NewMetrics() *Metrics {
-	return &Metrics{
-		totalRequests:     make(map[string]int64),
-		statusCodes:       make(map[string]map[int]int64),
-		requestDurations:  make(map[string][]float64),
+	m := &Metrics{
+		shards:            make([]metricsShard, runtime.GOMAXPROCS(0)),
 		appStartTimestamp: time.Now().Unix(),
 	}
+	for i := range m.shards {
+		m.shards[i].paths = make(map[string]*pathMetrics)
+		m.shards[i].slo = make(map[string]*sloCounters)
+	}
+	return m
 }
 
-// RecordRequest records metrics for a request
-func (m *Metrics) RecordRequest(path string, statusCode int, duration time.Duration) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+// shard picks the shard a request is recorded into
+func (m *Metrics) shard() *metricsShard {
+	return &m.shards[rand.IntN(len(m.shards))]
+}
 
-	// Clean path for metric name (replace non-alphanumeric chars with underscore)
+// path returns the series of a path, creating them on first use. The caller must hold the lock.
+func (s *metricsShard) path(cleanPath string) *pathMetrics {
+	pm, ok := s.paths[cleanPath]
+	if !ok {
+		pm = &pathMetrics{statusCodes: make(map[int]int64)}
+		s.paths[cleanPath] = pm
+	}
+	return pm
+}
 
+// cleanMetricPath turns a request path into a metric label value
+func cleanMetricPath(path string) string {
+	// Clean path for metric name (replace non-alphanumeric chars with underscore)
 	cleanPath := strings.Map(func(r rune) rune {
 		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9' || r == '/') {
 			return r
 		}
 		return '_'
 	}, path)
-	fmt.Printf("Path: %s : %s\n", path, cleanPath)
 	if cleanPath == "" || cleanPath[0] == '_' {
 		cleanPath = "root" + cleanPath
 	}
+	return cleanPath
+}
+
+// RecordRequest records metrics for a request
+func (m *Metrics) RecordRequest(path, method string, statusCode int, duration time.Duration, bytesWritten int64) {
+	cleanPath := cleanMetricPath(path)
+	s := m.shard()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pm := s.path(cleanPath)
 
 	// Increment total requests counter
-	m.totalRequests[cleanPath]++
+	pm.requests++
 
 	// Increment status code counter
-	if _, exists := m.statusCodes[cleanPath]; !exists {
-		m.statusCodes[cleanPath] = make(map[int]int64)
-	}
-	m.statusCodes[cleanPath][statusCode]++
+	pm.statusCodes[statusCode]++
 
 	// Record request duration
-	m.requestDurations[cleanPath] = append(m.requestDurations[cleanPath], duration.Seconds())
+	pm.durations.observe(duration.Seconds())
+
+	// Account response bandwidth
+	pm.bytes += bytesWritten
+
+	// Count the request against the objectives of its route
+	s.recordSLO(path, statusCode, duration)
+
+	// Keep the request for the sliding window summary
+	s.recordSample(requestSample{
+		at:       time.Now(),
+		path:     cleanPath,
+		method:   method,
+		status:   statusCode,
+		duration: duration,
+	}, m.samplesPerShard())
+}
+
+// RecordPanic records a recovered handler panic
+func (m *Metrics) RecordPanic(path string) {
+	s := m.shard()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.path(cleanMetricPath(path)).panics++
+}
+
+// pathSnapshot is a copy of the series of one path
+type pathSnapshot struct {
+	path string
+	pathMetrics
+}
+
+// snapshot merges the per-path series of all shards sorted by path, so they can be written
+// without holding any lock. Each shard is locked only while it is copied.
+func (m *Metrics) snapshot() []pathSnapshot {
+	merged := make(map[string]*pathSnapshot)
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mutex.Lock()
+		for path, pm := range s.paths {
+			snapshot, ok := merged[path]
+			if !ok {
+				snapshot = &pathSnapshot{path: path, pathMetrics: pathMetrics{statusCodes: make(map[int]int64)}}
+				merged[path] = snapshot
+			}
+			snapshot.merge(pm)
+		}
+		s.mutex.Unlock()
+	}
+
+	snapshots := make([]pathSnapshot, 0, len(merged))
+	for _, snapshot := range merged {
+		snapshots = append(snapshots, *snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].path < snapshots[j].path })
+	return snapshots
 }
 
-// GetPrometheusMetrics returns metrics in Prometheus format
-func (m *Metrics) GetPrometheusMetrics() string {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
+// WritePrometheusMetrics streams metrics in Prometheus format. The lock is only held while
+// the series are copied, never while writing to the client.
+func (m *Metrics) WritePrometheusMetrics(w io.Writer) error {
+	out := bufio.NewWriterSize(w, 32*1024)
+	paths := m.snapshot()
 
 	var sb strings.Builder
 
 	// Application info metric
 	sb.WriteString("# HELP app_info Information about the application\n")
 	sb.WriteString("# TYPE app_info gauge\n")
-	sb.WriteString(fmt.Sprintf("app_info{version=\"%s\"} 1\n\n", version))
+	info := currentBuildInfo()
+	sb.WriteString(fmt.Sprintf("app_info{version=\"%s\",commit=\"%s\",build_date=\"%s\",go_version=\"%s\"} 1\n\n",
+		info.Version, info.Commit, info.BuildDate, info.GoVersion))
+
+	// Telemetry resource attributes
+	writeTargetInfo(&sb)
 
 	// Application uptime metric
 	sb.WriteString("# HELP app_uptime_seconds How long the application has been running\n")
 	sb.WriteString("# TYPE app_uptime_seconds counter\n")
 	sb.WriteString(fmt.Sprintf("app_uptime_seconds %d\n\n", time.Now().Unix()-m.appStartTimestamp))
+	out.WriteString(sb.String())
 
 	// Request counter metric
-	sb.WriteString("# HELP http_requests_total Total number of HTTP requests\n")
-	sb.WriteString("# TYPE http_requests_total counter\n")
-	for path, count := range m.totalRequests {
-		sb.WriteString(fmt.Sprintf("http_requests_total{path=\"%s\"} %d\n", path, count))
+	out.WriteString("# HELP http_requests_total Total number of HTTP requests\n")
+	out.WriteString("# TYPE http_requests_total counter\n")
+	for _, p := range paths {
+		if p.requests > 0 {
+			fmt.Fprintf(out, "http_requests_total{path=\"%s\"} %d\n", p.path, p.requests)
+		}
 	}
-	sb.WriteString("\n")
+	out.WriteString("\n")
 
 	// Status code counter metric
-	sb.WriteString("# HELP http_response_status_total HTTP response status codes\n")
-	sb.WriteString("# TYPE http_response_status_total counter\n")
-	for path, codes := range m.statusCodes {
-		for code, count := range codes {
-			sb.WriteString(fmt.Sprintf("http_response_status_total{path=\"%s\",code=\"%d\"} %d\n", path, code, count))
+	out.WriteString("# HELP http_response_status_total HTTP response status codes\n")
+	out.WriteString("# TYPE http_response_status_total counter\n")
+	for _, p := range paths {
+		codes := make([]int, 0, len(p.statusCodes))
+		for code := range p.statusCodes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(out, "http_response_status_total{path=\"%s\",code=\"%d\"} %d\n", p.path, code, p.statusCodes[code])
 		}
 	}
-	sb.WriteString("\n")
-
-	// Request duration histogram
-	sb.WriteString("# HELP http_request_duration_seconds HTTP request duration in seconds\n")
-	sb.WriteString("# TYPE http_request_duration_seconds histogram\n")
-	// Define buckets for the histogram
-	buckets := []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
-
-	for path, durations := range m.requestDurations {
-		// Calculate counts for each bucket
-		bucketCounts := make([]int, len(buckets)+1)
-		var sum float64
-
-		for _, d := range durations {
-			sum += d
-			// Count in which bucket this duration falls
-			for i, b := range buckets {
-				if d <= b {
-					bucketCounts[i]++
-				}
-			}
-			bucketCounts[len(buckets)]++ // Count in the +Inf bucket
+	out.WriteString("\n")
+
+	// Response bytes counter metric
+	out.WriteString("# HELP http_response_bytes_total Total number of response body bytes sent\n")
+	out.WriteString("# TYPE http_response_bytes_total counter\n")
+	for _, p := range paths {
+		if p.requests > 0 {
+			fmt.Fprintf(out, "http_response_bytes_total{path=\"%s\"} %d\n", p.path, p.bytes)
+		}
+	}
+	out.WriteString("\n")
+
+	// Panic counter metric
+	out.WriteString("# HELP http_panics_total Total number of recovered handler panics\n")
+	out.WriteString("# TYPE http_panics_total counter\n")
+	for _, p := range paths {
+		if p.panics > 0 {
+			fmt.Fprintf(out, "http_panics_total{path=\"%s\"} %d\n", p.path, p.panics)
 		}
+	}
+	out.WriteString("\n")
+
+	sb.Reset()
+
+	// Client connections by state
+	writeConnectionMetrics(&sb)
+	writeConnLimitMetrics(&sb)
+	writeConcurrencyMetrics(&sb)
+	writeTarpitMetrics(&sb)
+	writeAccessLogMetrics(&sb)
+	writeMetricsStateMetrics(&sb)
+
+	// Route objectives
+	m.writeSLOMetrics(&sb)
+
+	// Backend pool metrics
+	backends.writeMetrics(&sb)
 
-		// Write the bucket observations
-		for i, b := range buckets {
-			sb.WriteString(fmt.Sprintf("http_request_duration_seconds_bucket{path=\"%s\",le=\"%g\"} %d\n",
-				path, b, bucketCounts[i]))
+	// Synthetic probe results
+	writeSyntheticProbeMetrics(&sb)
+
+	// Backend DNS cache metrics
+	dnsCache.writeMetrics(&sb)
+
+	// Configuration reload metrics
+	writeConfigReloadMetrics(&sb)
+
+	// Request coalescing metrics
+	writeCoalesceMetrics(&sb)
+	writeStreamMetrics(&sb)
+
+	// Response cache metrics
+	responseCache.writeMetrics(&sb)
+	out.WriteString(sb.String())
+
+	// Request duration histogram, buckets are cumulative in the exposition
+	out.WriteString("# HELP http_request_duration_seconds HTTP request duration in seconds\n")
+	out.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	for _, p := range paths {
+		if p.durations.count == 0 {
+			continue
+		}
+		var cumulative int64
+		for i, b := range durationBuckets {
+			cumulative += p.durations.counts[i]
+			fmt.Fprintf(out, "http_request_duration_seconds_bucket{path=\"%s\",le=\"%g\"} %d\n", p.path, b, cumulative)
 		}
-		sb.WriteString(fmt.Sprintf("http_request_duration_seconds_bucket{path=\"%s\",le=\"+Inf\"} %d\n",
-			path, bucketCounts[len(buckets)]))
+		fmt.Fprintf(out, "http_request_duration_seconds_bucket{path=\"%s\",le=\"+Inf\"} %d\n", p.path, p.durations.count)
 
 		// Write sum and count
-		sb.WriteString(fmt.Sprintf("http_request_duration_seconds_sum{path=\"%s\"} %g\n", path, sum))
-		sb.WriteString(fmt.Sprintf("http_request_duration_seconds_count{path=\"%s\"} %d\n", path, len(durations)))
+		fmt.Fprintf(out, "http_request_duration_seconds_sum{path=\"%s\"} %g\n", p.path, p.durations.sum)
+		fmt.Fprintf(out, "http_request_duration_seconds_count{path=\"%s\"} %d\n", p.path, p.durations.count)
 	}
 
-	return sb.String()
+	return out.Flush()
 }
 
 // AccessLogMiddleware logs details about incoming requests
@@ -167,62 +459,150 @@ func AccessLogMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		requestStart := time.Now()
 
+		// Tag the request with an ID shared by logs, error pages and the backend
+		r = ensureRequestID(w, r)
+
 		// Create a responseWriter that captures the status code
 		rw := &responseWriter{
 			ResponseWriter: w,
 			statusCode:     http.StatusOK, // Default status code
 		}
 
-		// Call the next handler
-		next(rw, r)
+		// Log and record metrics even when the handler aborts the response
+		defer func() {
+			// Calculate request duration
+			duration := time.Since(requestStart)
 
-		// Calculate request duration
-		duration := time.Since(requestStart)
+			// Routes may opt out of logging and metrics, e.g. frequent probes and scrapes
+			route := getConfig().route(r.URL.Path)
+			if !route.applies("accesslog") {
+				if route.applies("metrics") {
+					metrics.RecordRequest(r.URL.Path, r.Method, rw.statusCode, duration, rw.bytesWritten)
+				}
+				return
+			}
 
-		// Log the request details
-		accessLogger.Printf("%s - \"%s %s %s\" %d User-Agent: %s X-Forwarded-For: %s Trace-Id: %s X-B3-TraceId: %s X-B3-ParentSpanId: %s - %s",
-			r.RemoteAddr,
-			r.Method,
-			r.URL.Path,
-			r.Proto,
-			rw.statusCode,
-			r.Header.Get("User-Agent"),
-			r.Header.Get("X-Forwarded-For"),
-			r.Header.Get("Trace-Id"),
-			r.Header.Get("X-B3-TraceId"),
-			r.Header.Get("X-B3-ParentSpanId"),
-			duration,
-		)
+			// Log the request details
+			accessLogger.Printf("%s - \"%s %s %s\" %d User-Agent: %s X-Forwarded-For: %s Trace-Id: %s X-B3-TraceId: %s X-B3-ParentSpanId: %s Request-Id: %s - %s",
+				r.RemoteAddr,
+				r.Method,
+				r.URL.Path,
+				r.Proto,
+				rw.statusCode,
+				r.Header.Get("User-Agent"),
+				r.Header.Get("X-Forwarded-For"),
+				r.Header.Get("Trace-Id"),
+				r.Header.Get("X-B3-TraceId"),
+				r.Header.Get("X-B3-ParentSpanId"),
+				requestIDFromContext(r.Context()),
+				duration,
+			)
+
+			// Record metrics
+			if route.applies("metrics") {
+				metrics.RecordRequest(r.URL.Path, r.Method, rw.statusCode, duration, rw.bytesWritten)
+			}
+		}()
 
-		// Record metrics
-		metrics.RecordRequest(r.URL.Path, rw.statusCode, duration)
+		// Call the next handler
+		next(rw, r)
 	}
 }
 
 // responseWriter is a wrapper around http.ResponseWriter that captures the status code
 type responseWriter struct {
 	http.ResponseWriter
-	statusCode int
+	statusCode   int
+	bytesWritten int64
+	wroteHeader  bool
 }
 
 // WriteHeader captures the status code before writing it
 func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
+	if !rw.wroteHeader {
+		rw.statusCode = code
+		rw.wroteHeader = true
+	}
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Write counts the body bytes sent to the client
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytesWritten += int64(n)
+	return n, err
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// headerWritten reports whether the response status has been sent
+func (rw *responseWriter) headerWritten() bool {
+	return rw.wroteHeader
+}
+
 // ForwardToBackend forwards the request to the backend URL
 func ForwardToBackend(w http.ResponseWriter, r *http.Request) {
 	// Only process requests for root path "/"
 	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// In dry-run mode the backend is never called
+	if dryRunEnabled {
+		writeDryRunResponse(w, r)
+		return
+	}
+
+	// In replay mode recorded responses are served instead of calling the backend
+	if vcrMode == "replay" {
+		replayRecordedResponse(w, r)
+		return
+	}
+
+	// In record mode the exchange is captured for later replay
+	var recording *cassette
+	if vcrMode == "record" {
+		var err error
+		recording, err = newCassette(r)
+		if errors.Is(err, errCassetteBodyTooLarge) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "Request body exceeds VCR_MAX_BODY_BYTES")
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Error reading request: %v", err))
+			return
+		}
+	}
+
+	// Choose a backend instance from the pool
+	target, err := backends.pick()
+	if err != nil {
+		writeError(w, r, http.StatusServiceUnavailable, fmt.Sprintf("Error forwarding to backend: %v", err))
+		return
+	}
+
+	// Bound the backend call by the deadline the client is willing to wait for
+	ctx := r.Context()
+	timeout, err := clientRequestTimeout(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
 	// Create a new request to the backend
-	req, err := http.NewRequest(r.Method, backendURL, r.Body)
+	req, err := http.NewRequestWithContext(ctx, r.Method, target.url, r.Body)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error creating request: %v", err), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Error creating request: %v", err))
 		return
 	}
 
@@ -233,15 +613,110 @@ func ForwardToBackend(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Send the request to the backend
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	// Credentials were checked by the proxy, routes may keep them from the backend
+	rc := getConfig().route(r.URL.Path)
+	rc.stripAuth(req.Header)
+	req.Header.Del(syntheticProbeTokenHeader)
+
+	// Routes choose the Host header and query string vhost-based backends see
+	req.URL.RawQuery = rc.outboundQuery(req.URL.RawQuery, r)
+	req.Host = rc.outboundHost(r)
+
+	// Keep the body framing and pass client trailers on, the transport announces them itself
+	req.ContentLength = r.ContentLength
+	req.Trailer = r.Trailer
+	req.Header.Del("Trailer")
+
+	// Pass the remaining budget on to the backend
+	if timeout > 0 {
+		req.Header.Set(requestTimeoutHeader, strconv.FormatInt(timeout.Milliseconds(), 10))
+	}
+
+	// Send the request to the backend, sharing the call with identical concurrent GETs
+	// and answering from the response cache where allowed
+	resp, err := responseCache.do(r, req, func(req *http.Request) (*http.Response, error) {
+		resp, err := doBackendRequest(r, req)
+		// A client that hung up or a deadline it set says nothing about the health of the backend
+		clientGone := errors.Is(err, context.Canceled) || r.Context().Err() != nil
+		if err != nil && !clientGone && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, errResponseTooLarge) && !errors.Is(err, errSigV4BodyTooLarge) {
+			backends.markFailure(target, err)
+		}
+		return resp, err
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		// Dial and DNS timeouts end in the same error, only this request's own deadline has a budget to name
+		msg := "Backend did not respond in time"
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			msg = fmt.Sprintf("Backend did not respond within %s", timeout)
+		}
+		writeError(w, r, http.StatusGatewayTimeout, msg)
+		return
+	}
+	if errors.Is(err, errResponseTooLarge) {
+		writeError(w, r, http.StatusBadGateway, "Backend response exceeds size limit")
+		return
+	}
+	if errors.Is(err, errSigV4BodyTooLarge) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "Request body exceeds BACKEND_SIGV4_MAX_BODY_BYTES")
+		return
+	}
+	var stall *streamStallError
+	if errors.As(err, &stall) {
+		writeError(w, r, http.StatusGatewayTimeout, fmt.Sprintf("Backend stopped sending the response: %v", stall))
+		return
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error forwarding to backend: %v", err), http.StatusServiceUnavailable)
+		writeError(w, r, http.StatusServiceUnavailable, fmt.Sprintf("Error forwarding to backend: %v", err))
 		return
 	}
 	defer resp.Body.Close()
 
+	// Reject responses that announce a body larger than the cap
+	if responseMaxBytes > 0 && resp.ContentLength > responseMaxBytes {
+		writeError(w, r, http.StatusBadGateway, "Backend response exceeds size limit")
+		return
+	}
+
+	// Verify and attach payload digests
+	body, err := checkResponseIntegrity(r, resp)
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, fmt.Sprintf("Backend response failed integrity check: %v", err))
+		return
+	}
+
+	if recording != nil {
+		body = recording.capture(resp, body)
+	}
+
+	// Decompress payloads the client cannot decode. Skipped when a digest of the
+	// backend bytes is attached, since it must match what is sent.
+	if !responseDigestEnabled {
+		decoded, err := decodeUnacceptedEncoding(r, resp, body)
+		if err != nil {
+			writeError(w, r, http.StatusBadGateway, fmt.Sprintf("Error decoding backend response: %v", err))
+			return
+		}
+		defer decoded.Close()
+		body = decoded
+	}
+
+	// Hold the status back until the body starts flowing, so a backend that stalls
+	// before sending any of it can still be answered with a 504
+	if streamIdleTimeout > 0 {
+		buffered := bufio.NewReader(body)
+		if _, err := buffered.Peek(1); errors.As(err, &stall) {
+			writeError(w, r, http.StatusGatewayTimeout, fmt.Sprintf("Backend stopped sending the response: %v", stall))
+			return
+		}
+		body = buffered
+	}
+
+	// Compress uncompressed payloads with the best encoding the client accepts
+	encoding := ""
+	if !responseDigestEnabled {
+		encoding = negotiateCompression(r, resp)
+	}
+
 	// Copy response headers
 	for name, values := range resp.Header {
 		for _, value := range values {
@@ -249,13 +724,48 @@ func ForwardToBackend(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	out := w
+	var compressor *compressWriter
+	if encoding != "" {
+		if compressor, err = newCompressWriter(w, encoding); err != nil {
+			log.Printf("Error creating %s encoder: %v", encoding, err)
+		} else {
+			out = compressor
+		}
+	}
+
+	// Declare backend trailers so they can follow the body
+	announced := announceTrailers(w, resp)
+
 	// Set response status code
 	w.WriteHeader(resp.StatusCode)
 
-	// Copy response body
-	_, err = io.Copy(w, resp.Body)
+	// Stream response body, flushing as it arrives when the length is unknown
+	_, err = streamResponseBody(out, body, resp.ContentLength < 0)
+	if compressor != nil {
+		// Close even after a failed copy, the encoder holds buffers and goroutines
+		if closeErr := compressor.Close(); err == nil {
+			err = closeErr
+		}
+	}
 	if err != nil {
-		log.Printf("Error copying response body: %v", err)
+		if errors.As(err, &stall) {
+			// The status is already sent, so the partial transfer can only be reported here
+			log.Printf("Backend stalled mid-response for %s %s: %v", r.Method, r.URL.RequestURI(), stall)
+		} else {
+			log.Printf("Error copying response body: %v", err)
+		}
+		// Abort the connection so a truncated body is not mistaken for a complete one
+		panic(http.ErrAbortHandler)
+	}
+
+	// Trailer values are only known once the body has been read
+	copyTrailers(w, resp, announced)
+
+	if recording != nil {
+		if err := recording.save(); err != nil {
+			log.Printf("Error recording backend response: %v", err)
+		}
 	}
 }
 
@@ -263,80 +773,223 @@ func ForwardToBackend(w http.ResponseWriter, r *http.Request) {
 func VersionHandler(w http.ResponseWriter, r *http.Request) {
 	// Only process requests for exact "/version" path
 	if r.URL.Path != "/version" {
-		http.NotFound(w, r)
+		NotFoundHandler(w, r)
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprintf(w, "Version: %s\n", version)
+	// Plain text unless the client asks for JSON
+	writeResponse(w, r, http.StatusOK, versionResponse(currentBuildInfo()))
 }
 
 // LivenessHandler checks if the application is live
 func LivenessHandler(w http.ResponseWriter, r *http.Request) {
 	// Only process requests for exact "/health/live" path
 	if r.URL.Path != "/health/live" {
-		http.NotFound(w, r)
+		NotFoundHandler(w, r)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"status":"UP","uptime":"%s"}`, time.Since(startTime).String())
+	writeResponse(w, r, http.StatusOK, newHealthPayload(livenessResponse{
+		Status: "UP",
+		Uptime: time.Since(startTime).String(),
+	}))
 }
 
 // ReadinessHandler checks if the application is ready to serve requests
 func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
 	// Only process requests for exact "/health/ready" path
 	if r.URL.Path != "/health/ready" {
-		http.NotFound(w, r)
+		NotFoundHandler(w, r)
+		return
+	}
+
+	// Report not ready while no backend answers the (cached) probe
+	if err := checkReadiness(); err != nil {
+		writeResponse(w, r, http.StatusServiceUnavailable, newHealthPayload(readinessResponse{
+			Status:  "DOWN",
+			Backend: backendURL,
+			Error:   err.Error(),
+		}))
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"status":"UP","backend":"%s"}`, backendURL)
+	writeResponse(w, r, http.StatusOK, newHealthPayload(readinessResponse{
+		Status:  "UP",
+		Backend: backendURL,
+	}))
 }
 
 // MetricsHandler exposes application metrics in Prometheus format
 func MetricsHandler(w http.ResponseWriter, r *http.Request) {
 	// Only process requests for exact "/metrics" path
 	if r.URL.Path != "/metrics" {
-		http.NotFound(w, r)
+		NotFoundHandler(w, r)
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprint(w, metrics.GetPrometheusMetrics())
+	if err := metrics.WritePrometheusMetrics(newMetricNamingWriter(w)); err != nil {
+		log.Printf("Error writing metrics: %v", err)
+	}
 }
 
 // NotFoundHandler handles requests to undefined paths
 func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusNotFound)
-	fmt.Fprintf(w, `{"status":"Not Found","message":"The requested URI does not exist","path":"%s"}`, r.URL.Path)
+	writeError(w, r, http.StatusNotFound, "The requested URI does not exist")
 }
 
-func main() {
-	// Log configuration on startup
-	log.Printf("Starting server with VERSION=%s and BACKEND=%s", version, backendURL)
-
+// newRouter registers the routes of the groups a listener exposes
+func newRouter(lc listenerConfig) http.Handler {
 	// Create a custom ServeMux to handle routes
 	mux := http.NewServeMux()
 
-	// Register routes
-	mux.HandleFunc("/", AccessLogMiddleware(ForwardToBackend))
-	mux.HandleFunc("/version", AccessLogMiddleware(VersionHandler))
-	mux.HandleFunc("/health/live", AccessLogMiddleware(LivenessHandler))
-	mux.HandleFunc("/health/ready", AccessLogMiddleware(ReadinessHandler))
-	mux.HandleFunc("/metrics", AccessLogMiddleware(MetricsHandler))
+	// Middlewares that routes can opt out of through the "routes" section of CONFIG_FILE
+	recovery := Skippable("recovery", RecoveryMiddleware)
+	signature := Skippable("signature", SignatureMiddleware)
+	multipart := Skippable("multipart", MultipartMiddleware)
+	throttle := Skippable("throttle", ThrottleMiddleware)
+	admin := Skippable("admin", AdminMiddleware)
+	concurrency := Skippable("concurrency", ConcurrencyLimitMiddleware)
+	tarpit := Skippable("tarpit", TarpitMiddleware)
+	probe := HeadOptionsMiddleware
+
+	// Register routes, only proxied traffic goes through the concurrency limiter so probes and admin calls are never shed
+	if lc.exposes("proxy") {
+		mux.HandleFunc("/", AccessLogMiddleware(recovery(tarpit(concurrency(signature(multipart(throttle(ForwardToBackend))))))))
+	} else {
+		mux.HandleFunc("/", AccessLogMiddleware(recovery(NotFoundHandler)))
+	}
+	if lc.exposes("info") {
+		mux.HandleFunc("/version", AccessLogMiddleware(recovery(probe(VersionHandler))))
+		mux.HandleFunc("/info", AccessLogMiddleware(recovery(probe(InfoHandler))))
+	}
+	if lc.exposes("health") {
+		mux.HandleFunc("/health/live", AccessLogMiddleware(recovery(probe(LivenessHandler))))
+		mux.HandleFunc("/health/ready", AccessLogMiddleware(recovery(probe(ReadinessHandler))))
+		mux.HandleFunc("/health/deep", AccessLogMiddleware(recovery(probe(DeepHealthHandler))))
+	}
+	if lc.exposes("metrics") {
+		mux.HandleFunc("/metrics", AccessLogMiddleware(recovery(probe(MetricsHandler))))
+		mux.HandleFunc("/stats", AccessLogMiddleware(recovery(probe(StatsHandler))))
+	}
+	if lc.exposes("admin") && (adminToken != "" || servesAdminWithoutToken(lc)) {
+		mux.HandleFunc("/debug/self", AccessLogMiddleware(recovery(admin(SelfDiagnosticsHandler))))
+		mux.HandleFunc("/debug/dns/flush", AccessLogMiddleware(recovery(admin(DNSFlushHandler))))
+	}
+
+	// gRPC calls are proxied traffic as well
+	if lc.exposes("proxy") {
+		return grpcPassthrough(mux)
+	}
+	return mux
+}
+
+func main() {
+	// Probe a running instance instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(runHealthcheck(os.Args[2:]))
+	}
+
+	// Check the configuration without serving, CONFIG_FILE errors already stopped initialization
+	flag.Parse()
+	if *validateConfigOnly {
+		os.Exit(runValidateConfig())
+	}
+	// Refuse to start rather than serve with settings that silently fell back to defaults
+	if err := envError(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// Log configuration on startup
+	log.Printf("Starting server with VERSION=%s (commit %s, built %s) and BACKEND=%s", version, buildCommit, buildDate, backendURL)
+	if dryRunEnabled {
+		log.Printf("DRY_RUN enabled, requests will not be forwarded to the backend")
+	}
 
 	// Start the server with the custom handler
-	port := os.Getenv("PORT")
+	port := lookupSetting("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	log.Printf("Server starting on port %s", port)
-	if err := http.ListenAndServe(":"+port, mux); err != nil {
+	// Every listener gets a handler for its own route groups, connections that did not come
+	// through one of them see all routes
+	specs := listenerSpecs(port)
+	if adminToken == "" && !slices.ContainsFunc(specs, servesAdminWithoutToken) {
+		log.Printf("ADMIN_TOKEN is not set and no listener is dedicated to the admin group, admin endpoints are disabled")
+	}
+	server := &http.Server{
+		Handler:     dispatchByListener(newRouter(listenerConfig{})),
+		ConnContext: ListenerConnContext,
+		ConnState:   TrackConnState,
+	}
+	if err := configureH2C(server); err != nil {
+		log.Fatalf("Failed to configure HTTP/2: %v", err)
+	}
+
+	// Continue the counters of the previous run and keep saving them
+	restoreMetricsState()
+	go saveMetricsPeriodically()
+
+	// Start the stub upstream before anything tries to reach it
+	if mockBackendEnabled {
+		startMockBackend()
+	}
+
+	// Start active backend health checks
+	backends.startHealthChecks(context.Background())
+
+	// Reload CONFIG_FILE on SIGHUP
+	go watchConfigReload()
+
+	// Keep readiness down until the backends and declared dependencies answer
+	go waitForDependencies()
+
+	listeners, err := openListeners(specs)
+	if err != nil {
 		log.Fatalf("Server failed to start: %v", err)
 	}
+
+	// Serve every listener with the same server, the first failure stops the process
+	errs := make(chan error, len(listeners)+1)
+	quicServer := startHTTP3(server, specs, errs)
+	for i, ln := range listeners {
+		spec := specs[i]
+		handler := newRouter(spec)
+		if quicServer != nil && spec.TLS != nil {
+			handler = advertiseHTTP3(quicServer, handler)
+		}
+		ln = &routedListener{Listener: ln, handler: handler}
+		groups := strings.Join(spec.Groups, ", ")
+		if groups == "" {
+			groups = "all routes"
+		}
+		if spec.TLS != nil {
+			log.Printf("Server starting on %s (%s, https, %s)", ln.Addr(), ln.Addr().Network(), groups)
+			go func() {
+				errs <- server.ServeTLS(ln, spec.TLS.CertFile, spec.TLS.KeyFile)
+			}()
+			continue
+		}
+		log.Printf("Server starting on %s (%s, %s)", ln.Addr(), ln.Addr().Network(), groups)
+		go func() {
+			errs <- server.Serve(ln)
+		}()
+	}
+
+	// Send the configured synthetic probes through the proxy once it is serving
+	startSyntheticProbes(specs)
+
+	// Stop accepting connections on SIGTERM and let the open ones finish
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errs:
+		log.Fatalf("Server failed: %v", err)
+	case sig := <-shutdown:
+		log.Printf("Received %s, draining connections for up to %s", sig, shutdownTimeout)
+		drainServer(server, shutdownTimeout)
+		saveMetricsState()
+		flushAccessLog()
+	}
 }
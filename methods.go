@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Methods the built-in endpoints answer
+const builtinAllowedMethods = "GET, HEAD, OPTIONS"
+
+// HeadOptionsMiddleware answers OPTIONS with the allowed methods and serves HEAD as a GET
+// without body, so load balancers can probe the built-in endpoints with either method
+func HeadOptionsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodOptions:
+			w.Header().Set("Allow", builtinAllowedMethods)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodHead:
+			hw := &headResponseWriter{ResponseWriter: w}
+			next(hw, r)
+			hw.finish()
+		default:
+			next(w, r)
+		}
+	}
+}
+
+// headResponseWriter discards the body and holds back the status so the
+// Content-Length of the equivalent GET response can still be announced
+type headResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	length     int64
+}
+
+// WriteHeader remembers the first status code until the handler completes
+func (hw *headResponseWriter) WriteHeader(code int) {
+	if hw.statusCode == 0 {
+		hw.statusCode = code
+	}
+}
+
+// Write counts and drops the body
+func (hw *headResponseWriter) Write(b []byte) (int, error) {
+	if hw.statusCode == 0 {
+		hw.statusCode = http.StatusOK
+	}
+	hw.length += int64(len(b))
+	return len(b), nil
+}
+
+// Unwrap returns the underlying ResponseWriter
+func (hw *headResponseWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+// finish sends the held back headers
+func (hw *headResponseWriter) finish() {
+	if hw.statusCode == 0 {
+		hw.statusCode = http.StatusOK
+	}
+	if hw.Header().Get("Content-Length") == "" {
+		hw.Header().Set("Content-Length", strconv.FormatInt(hw.length, 10))
+	}
+	hw.ResponseWriter.WriteHeader(hw.statusCode)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var (
+	// Namespace prepended to every metric name, e.g. "orders" turns http_requests_total into orders_http_requests_total
+	metricPrefix string
+	// Labels added to every series, pre-rendered as name="value" pairs
+	metricStaticLabels string
+	// Names of the static labels, checked against the target_info labels once resources are known
+	metricStaticLabelNames []string
+	// Valid Prometheus metric and label names
+	metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNamePattern  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	// Label names the exposition uses itself, a static label with one of them would produce
+	// series with a duplicate label that scrapes reject
+	reservedLabelNames = []string{
+		"backend", "build_date", "code", "commit", "go_version", "host", "le", "method", "path",
+		"priority", "probe", "quantile", "reason", "result", "route", "slo", "state", "status", "version",
+	}
+)
+
+// Initialize metric naming settings from environment variables
+func init() {
+	if prefix := strings.TrimSuffix(lookupSetting("METRICS_PREFIX"), "_"); prefix != "" {
+		if !metricNamePattern.MatchString(prefix) {
+			log.Fatalf("Invalid METRICS_PREFIX=%q, it must be a valid metric name", prefix)
+		}
+		metricPrefix = prefix + "_"
+	}
+
+	// METRICS_STATIC_LABELS is a comma separated list of name=value pairs
+	var labels []string
+	for _, pair := range strings.Split(lookupSetting("METRICS_STATIC_LABELS"), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, value, found := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !found || !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			log.Fatalf("Invalid METRICS_STATIC_LABELS entry %q, expected name=value", pair)
+		}
+		if slices.Contains(reservedLabelNames, name) {
+			recordEnvError(fmt.Errorf("METRICS_STATIC_LABELS entry %q: %s is used by the metrics themselves", pair, name))
+			continue
+		}
+		metricStaticLabelNames = append(metricStaticLabelNames, name)
+		labels = append(labels, name+`="`+escapeLabelValue(strings.TrimSpace(value))+`"`)
+	}
+	metricStaticLabels = strings.Join(labels, ",")
+}
+
+// escapeLabelValue escapes a label value for the text exposition format
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// metricNamingWriter adds the configured prefix and static labels to every series of an
+// exposition as it is streamed through, one complete line at a time
+type metricNamingWriter struct {
+	w       io.Writer
+	partial []byte // Start of a line whose newline has not been written yet
+}
+
+// newMetricNamingWriter wraps w, or returns it as is when no naming options are set
+func newMetricNamingWriter(w io.Writer) io.Writer {
+	if metricPrefix == "" && metricStaticLabels == "" {
+		return w
+	}
+	return &metricNamingWriter{w: w}
+}
+
+// Write renames the complete lines in p and keeps any trailing partial line for the next call
+func (n *metricNamingWriter) Write(p []byte) (int, error) {
+	data := append(n.partial, p...)
+	var out []byte
+	for {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			break
+		}
+		out = append(out, renameMetricLine(string(data[:end]))...)
+		out = append(out, '\n')
+		data = data[end+1:]
+	}
+	n.partial = bytes.Clone(data)
+
+	if _, err := n.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// renameMetricLine applies the prefix and static labels to one line of an exposition
+func renameMetricLine(line string) string {
+	switch {
+	case line == "":
+		return line
+	case strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE "):
+		return line[:len("# HELP ")] + metricPrefix + line[len("# HELP "):]
+	case strings.HasPrefix(line, "#"):
+		return line
+	default:
+		return metricPrefix + addStaticLabels(line)
+	}
+}
+
+// addStaticLabels inserts the static labels into a sample line
+func addStaticLabels(sample string) string {
+	if metricStaticLabels == "" {
+		return sample
+	}
+	if brace := strings.IndexByte(sample, '{'); brace >= 0 && brace < strings.IndexByte(sample, ' ') {
+		if strings.HasPrefix(sample[brace+1:], "}") {
+			return sample[:brace+1] + metricStaticLabels + sample[brace+1:]
+		}
+		return sample[:brace+1] + metricStaticLabels + "," + sample[brace+1:]
+	}
+	name, rest, _ := strings.Cut(sample, " ")
+	return name + "{" + metricStaticLabels + "} " + rest
+}
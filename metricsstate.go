@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// File the cumulative request counters are kept in across restarts, empty disables it. Each
+	// instance needs its own file, replicas sharing one would add up each other's counters.
+	metricsStateFile = lookupSetting("METRICS_STATE_FILE")
+	// How often the counters are saved while running, they are always saved on shutdown
+	metricsSaveInterval = getEnvDuration("METRICS_SAVE_INTERVAL", time.Minute)
+	// Unix time of the last successful save
+	lastMetricsSave atomic.Int64
+	// Saves that could not be written
+	metricsSaveFailures atomic.Int64
+	// Serializes the periodic save and the one on shutdown, so an older snapshot never
+	// replaces a newer one
+	metricsSaveMutex sync.Mutex
+)
+
+// metricsState is the on-disk form of the per-path series
+type metricsState struct {
+	SavedAt         time.Time                   `json:"saved_at"`
+	DurationBuckets []float64                   `json:"duration_buckets"`
+	Paths           map[string]pathMetricsState `json:"paths"`
+}
+
+// pathMetricsState holds the counters of one path
+type pathMetricsState struct {
+	Requests       int64         `json:"requests"`
+	StatusCodes    map[int]int64 `json:"status_codes"`
+	Bytes          int64         `json:"bytes"`
+	Panics         int64         `json:"panics"`
+	DurationCounts []int64       `json:"duration_counts"`
+	DurationSum    float64       `json:"duration_sum"`
+	DurationCount  int64         `json:"duration_count"`
+}
+
+// saveState writes the per-path counters to a file atomically
+func (m *Metrics) saveState(path string) error {
+	state := metricsState{
+		SavedAt:         time.Now(),
+		DurationBuckets: durationBuckets[:],
+		Paths:           make(map[string]pathMetricsState),
+	}
+	for _, p := range m.snapshot() {
+		state.Paths[p.path] = pathMetricsState{
+			Requests:       p.requests,
+			StatusCodes:    p.statusCodes,
+			Bytes:          p.bytes,
+			Panics:         p.panics,
+			DurationCounts: p.durations.counts[:],
+			DurationSum:    p.durations.sum,
+			DurationCount:  p.durations.count,
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Write atomically so a crash during the save leaves the previous state intact. The data is
+	// synced before the rename, which could otherwise reach the disk before the content.
+	f, err := os.CreateTemp(filepath.Dir(path), ".metrics-state-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// restoreState adds previously saved counters to the first shard. Histograms saved with
+// other bucket bounds are skipped, the counters are still restored.
+func (m *Metrics) restoreState(path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var state metricsState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return time.Time{}, describeJSONError(data, err)
+	}
+	sameBuckets := slices.Equal(state.DurationBuckets, durationBuckets[:])
+
+	s := &m.shards[0]
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for cleanPath, saved := range state.Paths {
+		restored := pathMetrics{
+			requests:    saved.Requests,
+			statusCodes: saved.StatusCodes,
+			bytes:       saved.Bytes,
+			panics:      saved.Panics,
+		}
+		if sameBuckets && len(saved.DurationCounts) == len(restored.durations.counts) {
+			copy(restored.durations.counts[:], saved.DurationCounts)
+			restored.durations.sum = saved.DurationSum
+			restored.durations.count = saved.DurationCount
+		}
+		s.path(cleanPath).merge(&restored)
+	}
+	return state.SavedAt, nil
+}
+
+// restoreMetricsState loads the counters saved by the previous run, a missing file is a fresh start
+func restoreMetricsState() {
+	if metricsStateFile == "" {
+		return
+	}
+	savedAt, err := metrics.restoreState(metricsStateFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		log.Printf("No saved metrics in METRICS_STATE_FILE=%s, starting from zero", metricsStateFile)
+	case err != nil:
+		log.Printf("Failed to restore metrics from METRICS_STATE_FILE=%s, starting from zero: %v", metricsStateFile, err)
+	default:
+		log.Printf("Restored metrics saved at %s from METRICS_STATE_FILE=%s", savedAt.Format(time.RFC3339), metricsStateFile)
+	}
+}
+
+// saveMetricsState writes the counters to METRICS_STATE_FILE when it is configured
+func saveMetricsState() {
+	if metricsStateFile == "" {
+		return
+	}
+	metricsSaveMutex.Lock()
+	defer metricsSaveMutex.Unlock()
+	if err := metrics.saveState(metricsStateFile); err != nil {
+		metricsSaveFailures.Add(1)
+		log.Printf("Failed to save metrics to METRICS_STATE_FILE=%s: %v", metricsStateFile, err)
+		return
+	}
+	lastMetricsSave.Store(time.Now().Unix())
+}
+
+// saveMetricsPeriodically saves the counters every METRICS_SAVE_INTERVAL, so a crash loses
+// at most one interval
+func saveMetricsPeriodically() {
+	if metricsStateFile == "" || metricsSaveInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(metricsSaveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		saveMetricsState()
+	}
+}
+
+// writeMetricsStateMetrics appends metrics persistence metrics in Prometheus format
+func writeMetricsStateMetrics(sb *strings.Builder) {
+	if metricsStateFile == "" {
+		return
+	}
+	sb.WriteString("# HELP metrics_state_last_save_timestamp_seconds Unix time the counters were last saved to METRICS_STATE_FILE\n")
+	sb.WriteString("# TYPE metrics_state_last_save_timestamp_seconds gauge\n")
+	sb.WriteString(fmt.Sprintf("metrics_state_last_save_timestamp_seconds %d\n", lastMetricsSave.Load()))
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP metrics_state_save_failures_total Saves of the counters to METRICS_STATE_FILE that failed\n")
+	sb.WriteString("# TYPE metrics_state_save_failures_total counter\n")
+	sb.WriteString(fmt.Sprintf("metrics_state_save_failures_total %d\n", metricsSaveFailures.Load()))
+	sb.WriteString("\n")
+}
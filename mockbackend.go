@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// Run a stub upstream in the same process
+	mockBackendEnabled = lookupSetting("MOCK_BACKEND") == "true"
+	// Port the stub upstream listens on (loopback only)
+	mockBackendPort = getEnv("MOCK_BACKEND_PORT", "9090")
+)
+
+// mockBackendConfig defines the stub upstream responses
+type mockBackendConfig struct {
+	Stubs []mockStub `json:"stubs"`
+}
+
+// mockStub is a canned response for a path and optional method
+type mockStub struct {
+	Path    string            `json:"path"`
+	Method  string            `json:"method"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	JSON    json.RawMessage   `json:"json"`
+	Latency duration          `json:"latency"`
+}
+
+// validate checks that stubs are well formed and no two of them answer the same request
+func (c *mockBackendConfig) validate() error {
+	seen := make(map[string]int)
+	for i, stub := range c.Stubs {
+		if !strings.HasPrefix(stub.Path, "/") {
+			return fmt.Errorf("stubs[%d]: path %q must start with /", i, stub.Path)
+		}
+		if stub.Status != 0 && (stub.Status < 100 || stub.Status > 599) {
+			return fmt.Errorf("stubs[%d]: status %d is not a valid HTTP status", i, stub.Status)
+		}
+		if stub.Body != "" && stub.JSON != nil {
+			return fmt.Errorf("stubs[%d]: body and json are mutually exclusive", i)
+		}
+		key := stub.Method + " " + stub.Path
+		if first, ok := seen[key]; ok {
+			return fmt.Errorf("stubs[%d]: same method and path as stubs[%d], it would never match", i, first)
+		}
+		seen[key] = i
+	}
+	return nil
+}
+
+// mockBackendURL returns the URL the proxy uses to reach the stub upstream
+func mockBackendURL() string {
+	return fmt.Sprintf("http://127.0.0.1:%s/", mockBackendPort)
+}
+
+// findMockStub returns the first stub matching the request
+func findMockStub(r *http.Request) *mockStub {
+	stubs := getConfig().MockBackend.Stubs
+	for i := range stubs {
+		if stubs[i].Path == r.URL.Path && (stubs[i].Method == "" || stubs[i].Method == r.Method) {
+			return &stubs[i]
+		}
+	}
+	return nil
+}
+
+// mockResponse is the body served for paths without a stub
+type mockResponse struct {
+	Mock   bool   `json:"mock"`
+	Method string `json:"method,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Path   string `json:"path"`
+}
+
+// MockBackendHandler serves the configured stub responses
+func MockBackendHandler(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+
+	stub := findMockStub(r)
+	if stub == nil {
+		// Without any stubs every path answers, so the binary works out of the box
+		if len(getConfig().MockBackend.Stubs) == 0 {
+			writeResponse(w, r, http.StatusOK, mockResponse{Mock: true, Method: r.Method, Path: r.URL.Path})
+			return
+		}
+		writeResponse(w, r, http.StatusNotFound, mockResponse{Mock: true, Error: "no stub for path", Path: r.URL.Path})
+		return
+	}
+
+	// Simulate upstream latency, giving up if the caller goes away
+	if stub.Latency > 0 {
+		select {
+		case <-time.After(time.Duration(stub.Latency)):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	for name, value := range stub.Headers {
+		w.Header().Set(name, value)
+	}
+	body := []byte(stub.Body)
+	if len(stub.JSON) > 0 {
+		body = stub.JSON
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "application/json")
+		}
+	}
+
+	status := stub.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// startMockBackend runs the stub upstream in the background
+func startMockBackend() {
+	addr := "127.0.0.1:" + mockBackendPort
+	server := &http.Server{Addr: addr, Handler: http.HandlerFunc(MockBackendHandler)}
+
+	log.Printf("Mock backend starting on %s with %d stubs", addr, len(getConfig().MockBackend.Stubs))
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			log.Fatalf("Mock backend failed to start: %v", err)
+		}
+	}()
+}
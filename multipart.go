@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+)
+
+// Total size cap used when only part limits are configured, validation buffers the whole body
+const defaultMultipartMaxBytes = 32 << 20
+
+var (
+	// Maximum total multipart body size in bytes, defaults to 32MiB once any limit is configured
+	multipartMaxBytes int64
+	// Maximum number of parts in a multipart body, 0 means unlimited
+	multipartMaxParts int64
+	// Maximum size of a single part in bytes, 0 means unlimited
+	multipartMaxPartBytes int64
+)
+
+// multipartLimitError marks a multipart body that violates a configured limit
+type multipartLimitError struct {
+	reason string
+}
+
+// Error describes the violated limit
+func (e *multipartLimitError) Error() string {
+	return e.reason
+}
+
+// Initialize multipart upload limits from environment variables
+func init() {
+	multipartMaxBytes = getEnvInt64("MULTIPART_MAX_BYTES", 0)
+	multipartMaxParts = getEnvInt64("MULTIPART_MAX_PARTS", 0)
+	multipartMaxPartBytes = getEnvInt64("MULTIPART_MAX_PART_BYTES", 0)
+
+	// Validated bodies are held in memory until they are forwarded, so they are never unbounded
+	if multipartMaxBytes < 0 {
+		log.Printf("Invalid MULTIPART_MAX_BYTES=%d, using %d", multipartMaxBytes, defaultMultipartMaxBytes)
+		recordEnvError(fmt.Errorf("MULTIPART_MAX_BYTES=%d must not be negative", multipartMaxBytes))
+		multipartMaxBytes = defaultMultipartMaxBytes
+	}
+	if multipartMaxBytes == 0 && (multipartMaxParts > 0 || multipartMaxPartBytes > 0) {
+		log.Printf("MULTIPART_MAX_BYTES is not set, capping validated multipart bodies at %d bytes", defaultMultipartMaxBytes)
+		multipartMaxBytes = defaultMultipartMaxBytes
+	}
+}
+
+// MultipartMiddleware validates multipart/form-data uploads before they are forwarded
+func MultipartMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Validation is disabled when no limits are configured
+		if multipartMaxBytes == 0 {
+			next(w, r)
+			return
+		}
+
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/form-data" {
+			next(w, r)
+			return
+		}
+
+		// Reject early when the declared length is already too large
+		if r.ContentLength > multipartMaxBytes {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "Multipart body exceeds size limit")
+			return
+		}
+
+		body, err := validateMultipart(r.Body, params["boundary"])
+		if err != nil {
+			log.Printf("Rejected multipart upload %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			var limitErr *multipartLimitError
+			if errors.As(err, &limitErr) {
+				writeError(w, r, http.StatusRequestEntityTooLarge, limitErr.Error())
+			} else {
+				writeError(w, r, http.StatusBadRequest, "Malformed multipart body")
+			}
+			return
+		}
+
+		// Forward the original bytes unchanged
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+
+		next(w, r)
+	}
+}
+
+// validateMultipart walks all parts of a multipart body while keeping a copy of the raw bytes
+func validateMultipart(body io.Reader, boundary string) ([]byte, error) {
+	if boundary == "" {
+		return nil, errors.New("missing boundary")
+	}
+
+	var raw bytes.Buffer
+	reader := io.LimitReader(body, multipartMaxBytes+1)
+	mr := multipart.NewReader(io.TeeReader(reader, &raw), boundary)
+
+	var parts int64
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if int64(raw.Len()) > multipartMaxBytes {
+				return nil, &multipartLimitError{"Multipart body exceeds size limit"}
+			}
+			return nil, err
+		}
+
+		parts++
+		if multipartMaxParts > 0 && parts > multipartMaxParts {
+			return nil, &multipartLimitError{fmt.Sprintf("Multipart body exceeds %d parts", multipartMaxParts)}
+		}
+
+		partReader := io.Reader(part)
+		if multipartMaxPartBytes > 0 {
+			partReader = io.LimitReader(part, multipartMaxPartBytes+1)
+		}
+		size, err := io.Copy(io.Discard, partReader)
+		if err != nil {
+			if int64(raw.Len()) > multipartMaxBytes {
+				return nil, &multipartLimitError{"Multipart body exceeds size limit"}
+			}
+			return nil, err
+		}
+		if multipartMaxPartBytes > 0 && size > multipartMaxPartBytes {
+			return nil, &multipartLimitError{fmt.Sprintf("Multipart part %q exceeds size limit", part.FormName())}
+		}
+	}
+
+	// Drain the epilogue so the forwarded body is complete
+	if _, err := io.Copy(io.Discard, io.TeeReader(reader, &raw)); err != nil {
+		return nil, err
+	}
+	if int64(raw.Len()) > multipartMaxBytes {
+		return nil, &multipartLimitError{"Multipart body exceeds size limit"}
+	}
+	return raw.Bytes(), nil
+}
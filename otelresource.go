@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// Service account namespace file mounted into every Kubernetes pod
+const kubernetesNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// telemetryResource describes this process with OpenTelemetry resource attributes. Detection runs
+// once on first use; OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override detected values.
+var telemetryResource = sync.OnceValue(func() *resource.Resource {
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(
+			semconv.ServiceName("simple-rest-go"),
+			semconv.ServiceVersion(version),
+		),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithOS(),
+		resource.WithProcessPID(),
+		resource.WithProcessRuntimeName(),
+		resource.WithProcessRuntimeVersion(),
+		resource.WithContainer(),
+		resource.WithDetectors(kubernetesDetector{}, cloudDetector{}),
+		resource.WithFromEnv(),
+	)
+	if errors.Is(err, resource.ErrPartialResource) {
+		log.Printf("Some telemetry resource attributes could not be detected: %v", err)
+	} else if err != nil {
+		log.Printf("Telemetry resource detection failed: %v", err)
+		return resource.Default()
+	}
+	return res
+})
+
+// kubernetesDetector reads pod metadata from the downward API environment variables and the
+// service account mount
+type kubernetesDetector struct{}
+
+// firstEnv returns the first non-empty environment variable of the given names
+func firstEnv(keys ...string) string {
+	for _, key := range keys {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Detect returns Kubernetes attributes, or an empty resource outside a cluster
+func (kubernetesDetector) Detect(context.Context) (*resource.Resource, error) {
+	if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return resource.Empty(), nil
+	}
+
+	var attrs []attribute.KeyValue
+	namespace := firstEnv("K8S_NAMESPACE_NAME", "POD_NAMESPACE")
+	if namespace == "" {
+		if data, err := os.ReadFile(kubernetesNamespaceFile); err == nil {
+			namespace = strings.TrimSpace(string(data))
+		}
+	}
+	if namespace != "" {
+		attrs = append(attrs, semconv.K8SNamespaceName(namespace))
+	}
+	// The pod's hostname is its name unless the spec overrides it
+	if name := firstEnv("K8S_POD_NAME", "POD_NAME", "HOSTNAME"); name != "" {
+		attrs = append(attrs, semconv.K8SPodName(name))
+	}
+	if uid := firstEnv("K8S_POD_UID", "POD_UID"); uid != "" {
+		attrs = append(attrs, semconv.K8SPodUID(uid))
+	}
+	if node := firstEnv("K8S_NODE_NAME", "NODE_NAME"); node != "" {
+		attrs = append(attrs, semconv.K8SNodeName(node))
+	}
+	if container := os.Getenv("K8S_CONTAINER_NAME"); container != "" {
+		attrs = append(attrs, semconv.K8SContainerName(container))
+	}
+	return resource.NewWithAttributes(semconv.SchemaURL, attrs...), nil
+}
+
+// cloudDetector recognizes managed platforms from the environment variables they inject.
+// Metadata services are not queried, so startup never waits on the network.
+type cloudDetector struct{}
+
+// Detect returns cloud provider attributes, or an empty resource when no platform is recognized
+func (cloudDetector) Detect(context.Context) (*resource.Resource, error) {
+	var attrs []attribute.KeyValue
+	switch {
+	case os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "":
+		attrs = append(attrs, semconv.CloudProviderAWS, semconv.CloudPlatformAWSLambda,
+			semconv.FaaSName(os.Getenv("AWS_LAMBDA_FUNCTION_NAME")))
+	case strings.HasPrefix(os.Getenv("AWS_EXECUTION_ENV"), "AWS_ECS"):
+		attrs = append(attrs, semconv.CloudProviderAWS, semconv.CloudPlatformAWSECS)
+	case os.Getenv("K_SERVICE") != "":
+		attrs = append(attrs, semconv.CloudProviderGCP, semconv.CloudPlatformGCPCloudRun,
+			semconv.FaaSName(os.Getenv("K_SERVICE")))
+		if revision := os.Getenv("K_REVISION"); revision != "" {
+			attrs = append(attrs, semconv.FaaSVersion(revision))
+		}
+	case os.Getenv("WEBSITE_SITE_NAME") != "":
+		attrs = append(attrs, semconv.CloudProviderAzure, semconv.CloudPlatformAzureAppService)
+	}
+	if len(attrs) == 0 {
+		return resource.Empty(), nil
+	}
+	if region := firstEnv("AWS_REGION", "AWS_DEFAULT_REGION", "REGION_NAME"); region != "" {
+		attrs = append(attrs, semconv.CloudRegion(region))
+	}
+	if project := os.Getenv("GOOGLE_CLOUD_PROJECT"); project != "" {
+		attrs = append(attrs, semconv.CloudAccountID(project))
+	}
+	return resource.NewWithAttributes(semconv.SchemaURL, attrs...), nil
+}
+
+// resourceAttributes returns the detected attributes as a string map
+func resourceAttributes() map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range telemetryResource().Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	return attrs
+}
+
+// Initialize the check of static metric labels against the resource attributes
+func init() {
+	// target_info carries every resource attribute as a label, a static label of the same
+	// name would repeat it and the scrape would be rejected
+	attrs := resourceAttributes()
+	labels := make(map[string]string, len(attrs))
+	for name := range attrs {
+		labels[sanitizeLabelName(name)] = name
+	}
+	for _, name := range metricStaticLabelNames {
+		if attr, ok := labels[name]; ok {
+			recordEnvError(fmt.Errorf("METRICS_STATIC_LABELS label %s clashes with the %s resource attribute on target_info", name, attr))
+		}
+	}
+}
+
+// sanitizeLabelName turns a resource attribute name into a label name, replacing the
+// characters labels cannot hold with underscores
+func sanitizeLabelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// writeTargetInfo appends the resource attributes as the target_info metric, following the
+// OpenTelemetry to Prometheus mapping with dots in attribute names replaced by underscores
+func writeTargetInfo(sb *strings.Builder) {
+	attrs := resourceAttributes()
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	labels := make([]string, 0, len(names))
+	for _, name := range names {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", sanitizeLabelName(name), escapeLabelValue(attrs[name])))
+	}
+
+	sb.WriteString("# HELP target_info Target metadata from OpenTelemetry resource detection\n")
+	sb.WriteString("# TYPE target_info gauge\n")
+	sb.WriteString(fmt.Sprintf("target_info{%s} 1\n", strings.Join(labels, ",")))
+	sb.WriteString("\n")
+}
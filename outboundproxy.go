@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Proxy selection shared by the backend and gRPC clients
+var backendProxy = backendProxyFunc()
+
+// backendProxyFunc returns the proxy selection used for backend requests.
+// BACKEND_PROXY_URL takes precedence over the standard HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables.
+// Requests to localhost and loopback addresses, such as the mock backend, never use a proxy.
+func backendProxyFunc() func(*http.Request) (*url.URL, error) {
+	rawURL := lookupSetting("BACKEND_PROXY_URL")
+	if rawURL == "" {
+		return http.ProxyFromEnvironment
+	}
+
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil || proxyURL.Host == "" {
+		log.Fatalf("Invalid BACKEND_PROXY_URL=%q: %v", rawURL, err)
+	}
+
+	// Credentials may be kept out of the URL
+	if username := lookupSetting("BACKEND_PROXY_USERNAME"); username != "" {
+		proxyURL.User = url.UserPassword(username, os.Getenv("BACKEND_PROXY_PASSWORD"))
+	}
+
+	noProxy := getEnv("BACKEND_NO_PROXY", getEnv("NO_PROXY", lookupSetting("no_proxy")))
+	log.Printf("Backend requests use proxy %s (bypass: %q)", proxyURL.Redacted(), noProxy)
+
+	// The same matching rules as the standard variables, including CIDRs and port-pinned entries
+	config := &httpproxy.Config{
+		HTTPProxy:  proxyURL.String(),
+		HTTPSProxy: proxyURL.String(),
+		NoProxy:    noProxy,
+	}
+	proxy := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
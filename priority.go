@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Priority tiers from lowest to highest, shed in this order when the limiter is saturated
+var priorityTiers = []string{"low", "normal", "high"}
+
+var (
+	// Maximum number of proxied requests in flight, 0 disables the limiter
+	concurrencyLimit int64
+	// Header clients may use to declare the priority of a request
+	priorityHeader string
+	// Networks whose priority header is honored. When empty every client may declare any
+	// priority, including high to avoid being shed, so set it when clients are not trusted.
+	priorityTrustedNetworks []*net.IPNet
+	// Share of the limit each tier may fill before its requests are shed
+	priorityShares = map[string]float64{"low": 0.7, "normal": 0.9, "high": 1}
+	// Requests in flight at which each tier is shed, derived from the limit and the shares
+	priorityCaps = make(map[string]int64)
+	// Proxied requests currently in flight
+	inFlightRequests atomic.Int64
+	// Requests rejected by the limiter by tier
+	shedRequests = struct {
+		mutex  sync.Mutex
+		counts map[string]int64
+	}{counts: make(map[string]int64)}
+)
+
+// Initialize concurrency limiter settings from environment variables
+func init() {
+	concurrencyLimit = getEnvInt64("CONCURRENCY_LIMIT", 0)
+	priorityHeader = getEnv("PRIORITY_HEADER", "X-Priority")
+
+	// PRIORITY_TRUSTED_NETWORKS is a comma separated list of CIDRs, e.g. "10.0.0.0/8,127.0.0.1/32"
+	for _, cidr := range strings.Split(lookupSetting("PRIORITY_TRUSTED_NETWORKS"), ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("Ignoring invalid PRIORITY_TRUSTED_NETWORKS entry %q", cidr)
+			recordEnvError(fmt.Errorf("PRIORITY_TRUSTED_NETWORKS entry %q is not a CIDR: %w", cidr, err))
+			continue
+		}
+		priorityTrustedNetworks = append(priorityTrustedNetworks, network)
+	}
+
+	// PRIORITY_SHARES overrides the shares as tier=fraction pairs, e.g. "low=0.5,normal=0.8"
+	for _, pair := range strings.Split(lookupSetting("PRIORITY_SHARES"), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		tier, value, _ := strings.Cut(pair, "=")
+		share, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if !slices.Contains(priorityTiers, strings.TrimSpace(tier)) || err != nil || share <= 0 || share > 1 {
+			log.Printf("Ignoring invalid PRIORITY_SHARES entry %q", pair)
+			recordEnvError(fmt.Errorf("PRIORITY_SHARES entry %q must be tier=fraction with a fraction in (0, 1]", pair))
+			continue
+		}
+		priorityShares[strings.TrimSpace(tier)] = share
+	}
+
+	if concurrencyLimit > 0 {
+		computePriorityCaps()
+	}
+}
+
+// computePriorityCaps turns the shares into caps, from the highest tier down. A tier with a
+// smaller share than the one above stays below its cap, so higher tiers always keep headroom
+// that lower ones cannot fill even when rounding would make the caps equal.
+func computePriorityCaps() {
+	above := int64(-1)
+	var aboveShare float64
+	for _, tier := range slices.Backward(priorityTiers) {
+		capacity := int64(float64(concurrencyLimit) * priorityShares[tier])
+		if above >= 0 && priorityShares[tier] < aboveShare {
+			capacity = min(capacity, above-1)
+		}
+		capacity = max(0, capacity)
+		if capacity == 0 {
+			recordEnvError(fmt.Errorf("CONCURRENCY_LIMIT=%d leaves the %s priority tier no slot below the caps of higher tiers", concurrencyLimit, tier))
+		}
+		priorityCaps[tier] = capacity
+		above, aboveShare = capacity, priorityShares[tier]
+	}
+}
+
+// priorityHeaderTrusted reports whether the priority header of a request is honored
+func priorityHeaderTrusted(r *http.Request) bool {
+	if len(priorityTrustedNetworks) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP(r))
+	return ip != nil && slices.ContainsFunc(priorityTrustedNetworks, func(network *net.IPNet) bool {
+		return network.Contains(ip)
+	})
+}
+
+// requestPriority classifies a request by its route, falling back to the priority header of
+// trusted clients
+func requestPriority(r *http.Request) string {
+	if rc := getConfig().route(r.URL.Path); rc != nil && rc.Priority != "" {
+		return rc.Priority
+	}
+	if !priorityHeaderTrusted(r) {
+		return "normal"
+	}
+	if tier := strings.ToLower(strings.TrimSpace(r.Header.Get(priorityHeader))); slices.Contains(priorityTiers, tier) {
+		return tier
+	}
+	return "normal"
+}
+
+// ConcurrencyLimitMiddleware bounds the number of proxied requests in flight. As the limit
+// is approached lower priority tiers are rejected first, each once its share is used up.
+// Health checks and admin endpoints are not wrapped and therefore always admitted, synthetic
+// probes bypass the limit so they neither take slots from clients nor get shed.
+func ConcurrencyLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if concurrencyLimit <= 0 || isSyntheticProbe(r) {
+			next(w, r)
+			return
+		}
+
+		tier := requestPriority(r)
+		if inFlightRequests.Add(1) > priorityCaps[tier] {
+			inFlightRequests.Add(-1)
+			shedRequests.mutex.Lock()
+			shedRequests.counts[tier]++
+			shedRequests.mutex.Unlock()
+
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, fmt.Sprintf("Server is at capacity, %s priority requests are being shed", tier))
+			return
+		}
+		defer inFlightRequests.Add(-1)
+
+		next(w, r)
+	}
+}
+
+// writeConcurrencyMetrics appends limiter metrics in Prometheus format
+func writeConcurrencyMetrics(sb *strings.Builder) {
+	if concurrencyLimit <= 0 {
+		return
+	}
+
+	sb.WriteString("# HELP concurrency_in_flight Proxied requests currently in flight\n")
+	sb.WriteString("# TYPE concurrency_in_flight gauge\n")
+	sb.WriteString(fmt.Sprintf("concurrency_in_flight %d\n", inFlightRequests.Load()))
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP concurrency_limit Maximum number of proxied requests in flight\n")
+	sb.WriteString("# TYPE concurrency_limit gauge\n")
+	sb.WriteString(fmt.Sprintf("concurrency_limit %d\n", concurrencyLimit))
+	sb.WriteString("\n")
+
+	shedRequests.mutex.Lock()
+	defer shedRequests.mutex.Unlock()
+	sb.WriteString("# HELP requests_shed_total Requests rejected by the concurrency limiter by priority\n")
+	sb.WriteString("# TYPE requests_shed_total counter\n")
+	for _, tier := range priorityTiers {
+		sb.WriteString(fmt.Sprintf("requests_shed_total{priority=\"%s\"} %d\n", tier, shedRequests.counts[tier]))
+	}
+	sb.WriteString("\n")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	// Actively probe the backends before reporting ready
+	readinessProbeBackend bool
+	// How long a readiness result is reused for
+	readinessCacheTTL time.Duration
+	// Timeout of the active readiness probe
+	readinessProbeTimeout time.Duration
+	// Coalesces concurrent readiness checks into one probe
+	readinessGroup singleflight.Group
+	// Last readiness result and when it expires
+	readinessCache struct {
+		mutex   sync.Mutex
+		err     error
+		expires time.Time
+	}
+)
+
+// Initialize readiness settings from environment variables
+func init() {
+	readinessProbeBackend = lookupSetting("READINESS_PROBE_BACKEND") == "true"
+	readinessCacheTTL = getEnvDuration("READINESS_CACHE_TTL", time.Second)
+	readinessProbeTimeout = getEnvDuration("READINESS_PROBE_TIMEOUT", 2*time.Second)
+}
+
+// checkReadiness returns nil when the service can serve traffic.
+// Results are cached and concurrent callers share a single backend probe.
+func checkReadiness() error {
+	if !startupComplete.Load() {
+		return errStartupPending
+	}
+	if !readinessProbeBackend {
+		return nil
+	}
+
+	readinessCache.mutex.Lock()
+	if time.Now().Before(readinessCache.expires) {
+		err := readinessCache.err
+		readinessCache.mutex.Unlock()
+		return err
+	}
+	readinessCache.mutex.Unlock()
+
+	result, _, _ := readinessGroup.Do("ready", func() (any, error) {
+		err := probeAnyBackend()
+
+		readinessCache.mutex.Lock()
+		readinessCache.err = err
+		readinessCache.expires = time.Now().Add(readinessCacheTTL)
+		readinessCache.mutex.Unlock()
+
+		return err, nil
+	})
+	err, _ := result.(error)
+	return err
+}
+
+// probeAnyBackend succeeds as soon as one backend answers the probe
+func probeAnyBackend() error {
+	// Shared probes must not depend on the context of whichever request triggered them
+	ctx, cancel := context.WithTimeout(context.Background(), readinessProbeTimeout)
+	defer cancel()
+
+	var errs []error
+	for _, b := range backends.backends {
+		err := probeBackend(ctx, b.url, readinessProbeTimeout)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// RecoveryMiddleware turns handler panics into 500 responses instead of dropping the connection
+func RecoveryMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// Deliberate aborts keep their meaning for the server
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			log.Printf("Panic serving %s %s (request %s): %v\n%s",
+				r.Method, r.URL.Path, requestIDFromContext(r.Context()), recovered, debug.Stack())
+			metrics.RecordPanic(r.URL.Path)
+
+			// A response already in flight cannot be replaced, so the connection is aborted
+			if hw, ok := w.(interface{ headerWritten() bool }); ok && hw.headerWritten() {
+				panic(http.ErrAbortHandler)
+			}
+			writeError(w, r, http.StatusInternalServerError, "An unexpected error occurred while processing the request")
+		}()
+
+		next(w, r)
+	}
+}
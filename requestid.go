@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// Header carrying the request ID between client, proxy and backend
+const requestIDHeader = "X-Request-Id"
+
+// requestIDContextKey is the context key holding the request ID
+type requestIDContextKey struct{}
+
+// ensureRequestID reuses the caller's request ID or generates one, and exposes it on the
+// request context, the forwarded request headers and the response headers
+func ensureRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > 128 {
+		id = newRequestID()
+		r.Header.Set(requestIDHeader, id)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id))
+}
+
+// newRequestID returns a random 128 bit hex identifier
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDFromContext returns the request ID stored by ensureRequestID
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// textResponse is implemented by responses that also have a plain text form, which is then
+// served to clients that state no preference
+type textResponse interface {
+	writeText(w io.Writer)
+}
+
+// writeResponse encodes a response in the format negotiated with the client. It is encoded
+// before anything is sent, so a value that cannot be encoded still gets a proper 500.
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, v any) {
+	encodeResponse(w, r, status, v, "")
+}
+
+// writeIndentedResponse is writeResponse with indented JSON, for endpoints mostly read by people
+func writeIndentedResponse(w http.ResponseWriter, r *http.Request, status int, v any) {
+	encodeResponse(w, r, status, v, "  ")
+}
+
+// encodeResponse writes a response as JSON, or as plain text when it has that form and the
+// client prefers it
+func encodeResponse(w http.ResponseWriter, r *http.Request, status int, v any, indent string) {
+	offers := []string{"application/json"}
+	text, hasText := v.(textResponse)
+	if hasText {
+		offers = []string{"text/plain", "application/json"}
+		w.Header().Add("Vary", "Accept")
+	}
+	contentType := negotiateContentType(r, offers...)
+
+	var buf bytes.Buffer
+	if contentType == "text/plain" {
+		text.writeText(&buf)
+	} else {
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", indent)
+		if err := encoder.Encode(v); err != nil {
+			log.Printf("Error encoding response for %s: %v", r.URL.Path, err)
+			writeError(w, r, http.StatusInternalServerError, "The response could not be encoded")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// negotiateContentType picks the offered media type the Accept header weighs highest. The
+// first offer wins ties and is used when the client accepts none of them, a probe with an
+// unusual Accept header still gets an answer rather than a 406.
+func negotiateContentType(r *http.Request, offers ...string) string {
+	accept := r.Header.Get("Accept")
+	best, bestQuality := offers[0], 0.0
+	if accept == "" {
+		return best
+	}
+	for _, offer := range offers {
+		if quality := acceptQuality(accept, offer); quality > bestQuality {
+			best, bestQuality = offer, quality
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the weight an Accept header gives a media type, taken from the most
+// specific range that matches it, 0 when none does
+func acceptQuality(accept, mediaType string) float64 {
+	quality, specificity := 0.0, -1
+	for _, entry := range strings.Split(accept, ",") {
+		params := strings.Split(entry, ";")
+		accepted := strings.ToLower(strings.TrimSpace(params[0]))
+
+		matched := -1
+		switch {
+		case accepted == mediaType:
+			matched = 2
+		case accepted == "*/*":
+			matched = 0
+		case strings.HasSuffix(accepted, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(accepted, "*")):
+			matched = 1
+		}
+		if matched <= specificity {
+			continue
+		}
+
+		weight := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(name) != "q" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				weight = q
+			}
+		}
+		quality, specificity = weight, matched
+	}
+	return quality
+}
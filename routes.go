@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Middleware names routes can select or opt out of
+var middlewareNames = []string{"accesslog", "metrics", "recovery", "signature", "multipart", "throttle", "admin", "concurrency", "tarpit"}
+
+// routeConfig holds per-route settings from the "routes" section of CONFIG_FILE.
+// Keys are exact paths, or prefixes when they end with "/".
+type routeConfig struct {
+	Middlewares []string          `json:"middlewares"`  // When set, only these middlewares apply
+	Skip        []string          `json:"skip"`         // Middlewares that do not apply
+	StripAuth   bool              `json:"strip_auth"`   // Remove client credentials before forwarding
+	SLO         *sloConfig        `json:"slo"`          // Service level objectives tracked for the route
+	Priority    string            `json:"priority"`     // Shedding tier, overrides the client's priority header
+	Host        string            `json:"host"`         // Outbound Host: "backend" (default), "client" or a fixed host
+	Query       string            `json:"query"`        // Client query string: "drop" (default), "forward" or "replace"
+	QuerySet    map[string]string `json:"query_set"`    // Query parameters set on the outbound request
+	QueryRemove []string          `json:"query_remove"` // Query parameters removed from the outbound request
+}
+
+// Request headers carrying end-user credentials, removed for routes with strip_auth
+var inboundAuthHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// applies reports whether a named middleware runs for the route
+func (rc *routeConfig) applies(name string) bool {
+	if rc == nil {
+		return true
+	}
+	if rc.Middlewares != nil && !slices.Contains(rc.Middlewares, name) {
+		return false
+	}
+	return !slices.Contains(rc.Skip, name)
+}
+
+// stripAuth removes client credentials from an outbound request when the route asks for it
+func (rc *routeConfig) stripAuth(header http.Header) {
+	if rc == nil || !rc.StripAuth {
+		return
+	}
+	for _, name := range inboundAuthHeaders {
+		header.Del(name)
+	}
+}
+
+// outboundHost returns the Host header sent to the backend, "" for the host of the backend URL
+func (rc *routeConfig) outboundHost(r *http.Request) string {
+	if rc == nil {
+		return ""
+	}
+	switch rc.Host {
+	case "", "backend":
+		return ""
+	case "client":
+		return r.Host
+	default:
+		return rc.Host
+	}
+}
+
+// outboundQuery combines the query of the backend URL with the client's as the route asks,
+// then applies its parameter rewrites
+func (rc *routeConfig) outboundQuery(backendQuery string, r *http.Request) string {
+	if rc == nil {
+		return backendQuery
+	}
+	query := backendQuery
+	switch rc.Query {
+	case "forward":
+		if query != "" && r.URL.RawQuery != "" {
+			query += "&"
+		}
+		query += r.URL.RawQuery
+	case "replace":
+		query = r.URL.RawQuery
+	}
+	if len(rc.QuerySet) == 0 && len(rc.QueryRemove) == 0 {
+		return query
+	}
+
+	// Rewriting re-encodes the query with its parameters sorted
+	values, _ := url.ParseQuery(query)
+	for _, name := range rc.QueryRemove {
+		values.Del(name)
+	}
+	for name, value := range rc.QuerySet {
+		values.Set(name, value)
+	}
+	return values.Encode()
+}
+
+// validate checks that only known middleware names and priorities are referenced and SLOs are well formed
+func (rc *routeConfig) validate() error {
+	if rc.Priority != "" && !slices.Contains(priorityTiers, rc.Priority) {
+		return fmt.Errorf("unknown priority %q, expected one of %s", rc.Priority, strings.Join(priorityTiers, ", "))
+	}
+	if rc.SLO != nil {
+		if err := rc.SLO.validate(); err != nil {
+			return fmt.Errorf("slo: %w", err)
+		}
+	}
+	for _, name := range append(slices.Clone(rc.Middlewares), rc.Skip...) {
+		if !slices.Contains(middlewareNames, name) {
+			return fmt.Errorf("unknown middleware %q, expected one of %s", name, strings.Join(middlewareNames, ", "))
+		}
+	}
+	for _, name := range rc.Skip {
+		if slices.Contains(rc.Middlewares, name) {
+			return fmt.Errorf("middleware %q is both selected and skipped", name)
+		}
+	}
+	if rc.Priority != "" && !rc.applies("concurrency") {
+		return errors.New("priority has no effect when the concurrency middleware does not apply")
+	}
+	if rc.Host != "" && rc.Host != "backend" && rc.Host != "client" {
+		if u, err := url.Parse("//" + rc.Host); err != nil || u.Host != rc.Host {
+			return fmt.Errorf("host %q must be backend, client or a host name with an optional port", rc.Host)
+		}
+	}
+	if rc.Query != "" && !slices.Contains([]string{"drop", "forward", "replace"}, rc.Query) {
+		return fmt.Errorf("unknown query mode %q, expected drop, forward or replace", rc.Query)
+	}
+	for _, name := range rc.QueryRemove {
+		if _, ok := rc.QuerySet[name]; ok {
+			return fmt.Errorf("query parameter %q is both set and removed", name)
+		}
+	}
+	return nil
+}
+
+// route returns the settings for a path, preferring exact matches over the longest prefix
+func (c *fileConfig) route(path string) *routeConfig {
+	_, rc := c.matchRoute(path)
+	return rc
+}
+
+// matchRoute returns the key and settings of the route a path belongs to, or nil when none matches
+func (c *fileConfig) matchRoute(path string) (string, *routeConfig) {
+	if rc, ok := c.Routes[path]; ok {
+		return path, &rc
+	}
+	var best string
+	for key := range c.Routes {
+		if strings.HasSuffix(key, "/") && strings.HasPrefix(path, key) && len(key) > len(best) {
+			best = key
+		}
+	}
+	if best == "" {
+		return "", nil
+	}
+	rc := c.Routes[best]
+	return best, &rc
+}
+
+// middlewareApplies reports whether a named middleware runs for a request
+func middlewareApplies(r *http.Request, name string) bool {
+	return getConfig().route(r.URL.Path).applies(name)
+}
+
+// Skippable wraps a middleware so routes can opt out of it by name
+func Skippable(name string, middleware func(http.HandlerFunc) http.HandlerFunc) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		wrapped := middleware(next)
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !middlewareApplies(r, name) {
+				next(w, r)
+				return
+			}
+			wrapped(w, r)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// HMAC keys by client ID, verification is disabled when empty
+	signatureKeys = make(map[string][]byte)
+	// Hash algorithm used for signatures (sha1, sha256 or sha512)
+	signatureAlgorithm string
+	// Header carrying the hex encoded signature
+	signatureHeader string
+	// Header identifying the calling client
+	signatureClientHeader string
+	// Header carrying the unix timestamp of the request
+	signatureTimestampHeader string
+	// Maximum age and clock skew of signed timestamps, 5m by default. Timestamps are checked
+	// whenever the signature or the timestamp header carries one, GitHub-style webhooks never
+	// send one. 0 disables the check.
+	signatureTolerance time.Duration
+	// Maximum request body size read for verification
+	signatureMaxBody int64
+	// Returned for bodies above HMAC_MAX_BODY_BYTES, answered with 413 rather than 401
+	errSignatureBodyTooLarge = errors.New("body too large to verify")
+)
+
+// Initialize signature verification settings from environment variables
+func init() {
+	// HMAC_KEYS is a comma separated list of client:secret pairs, e.g. "github:s3cr3t,stripe:whsec"
+	for _, entry := range strings.Split(os.Getenv("HMAC_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		client, secret, found := strings.Cut(entry, ":")
+		if !found {
+			// A bare secret is used for callers that do not send a client ID
+			client, secret = "default", entry
+		}
+		signatureKeys[client] = []byte(secret)
+	}
+
+	signatureAlgorithm = strings.ToLower(getEnv("HMAC_ALGORITHM", "sha256"))
+	if newSignatureHash(signatureAlgorithm) == nil {
+		log.Printf("Unsupported HMAC_ALGORITHM=%q, using sha256", signatureAlgorithm)
+		recordEnvError(fmt.Errorf("HMAC_ALGORITHM=%q is not supported", signatureAlgorithm))
+		signatureAlgorithm = "sha256"
+	}
+	signatureHeader = getEnv("HMAC_SIGNATURE_HEADER", "X-Signature")
+	signatureClientHeader = getEnv("HMAC_CLIENT_HEADER", "X-Client-Id")
+	signatureTimestampHeader = getEnv("HMAC_TIMESTAMP_HEADER", "X-Timestamp")
+	signatureTolerance = getEnvDuration("HMAC_TOLERANCE", 5*time.Minute)
+	signatureMaxBody = getEnvInt64("HMAC_MAX_BODY_BYTES", 10<<20)
+}
+
+// newSignatureHash returns the hash constructor for an algorithm name
+func newSignatureHash(algorithm string) func() hash.Hash {
+	switch algorithm {
+	case "sha1":
+		return sha1.New
+	case "sha256":
+		return sha256.New
+	case "sha512":
+		return sha512.New
+	}
+	return nil
+}
+
+// SignatureMiddleware rejects requests without a valid HMAC signature
+func SignatureMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Verification is disabled when no keys are configured
+		if len(signatureKeys) == 0 {
+			next(w, r)
+			return
+		}
+
+		if err := verifySignature(r); err != nil {
+			log.Printf("Signature verification failed for %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			if errors.Is(err, errSignatureBodyTooLarge) {
+				writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", signatureMaxBody))
+				return
+			}
+			writeError(w, r, http.StatusUnauthorized, "Invalid request signature")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// verifySignature checks the request signature and restores the body for forwarding
+func verifySignature(r *http.Request) error {
+	// Look up the key for the calling client
+	client := r.Header.Get(signatureClientHeader)
+	if client == "" {
+		client = "default"
+	}
+	key, ok := signatureKeys[client]
+	if !ok {
+		return fmt.Errorf("unknown client %q", client)
+	}
+
+	provided := r.Header.Get(signatureHeader)
+	if provided == "" {
+		return errors.New("missing signature header")
+	}
+	timestamp, expectedMACs, err := parseSignature(provided)
+	if err != nil {
+		return err
+	}
+	if timestamp == "" {
+		timestamp = r.Header.Get(signatureTimestampHeader)
+	}
+
+	// Refuse replays before spending a body read on them, a forged timestamp fails the
+	// signature check below as it is bound into the MAC
+	if timestamp != "" && signatureTolerance > 0 {
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return errors.New("malformed timestamp")
+		}
+		if skew := time.Since(time.Unix(seconds, 0)); skew > signatureTolerance || skew < -signatureTolerance {
+			return fmt.Errorf("timestamp outside tolerance (%s)", skew.Round(time.Second))
+		}
+	}
+
+	// Read the body so it can be signed and forwarded afterwards
+	body, err := io.ReadAll(io.LimitReader(r.Body, signatureMaxBody+1))
+	if err != nil {
+		return fmt.Errorf("reading body: %w", err)
+	}
+	if int64(len(body)) > signatureMaxBody {
+		return errSignatureBodyTooLarge
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(newSignatureHash(signatureAlgorithm), key)
+
+	// Bind the timestamp into the signature to prevent replays
+	if timestamp != "" {
+		mac.Write([]byte(timestamp + "."))
+	}
+	mac.Write(body)
+
+	// Any of the signatures may match, senders list several while rotating secrets
+	sum := mac.Sum(nil)
+	for _, expectedMAC := range expectedMACs {
+		if hmac.Equal(sum, expectedMAC) {
+			return nil
+		}
+	}
+	return errors.New("signature mismatch")
+}
+
+// parseSignature decodes the signature header. Besides hex with an optional algorithm prefix,
+// e.g. "sha256=<hex>", Stripe's "t=<unix>,v1=<hex>,..." form is understood, whose timestamp is
+// always part of the signed payload.
+func parseSignature(value string) (timestamp string, signatures [][]byte, err error) {
+	if !strings.HasPrefix(value, "t=") {
+		signature, err := hex.DecodeString(strings.TrimPrefix(value, signatureAlgorithm+"="))
+		if err != nil {
+			return "", nil, errors.New("malformed signature")
+		}
+		return "", [][]byte{signature}, nil
+	}
+
+	for _, part := range strings.Split(value, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = encoded
+		case "v1":
+			signature, err := hex.DecodeString(encoded)
+			if err != nil {
+				return "", nil, errors.New("malformed signature")
+			}
+			signatures = append(signatures, signature)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return "", nil, errors.New("malformed signature, expected t=<unix>,v1=<hex>")
+	}
+	return timestamp, signatures, nil
+}
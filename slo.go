@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sloConfig declares the objectives of a route. Requests answered with a 5xx status count
+// against availability, requests slower than Latency against the latency objective.
+type sloConfig struct {
+	Availability float64  `json:"availability"`   // Target fraction of successful requests, e.g. 0.999
+	Latency      duration `json:"latency"`        // Threshold a request must complete within
+	LatencyRatio float64  `json:"latency_target"` // Target fraction of requests within Latency, e.g. 0.99
+}
+
+// sloCounters are the request totals of a route with objectives
+type sloCounters struct {
+	requests int64
+	errors   int64
+	slow     int64
+}
+
+// validate checks that targets are fractions and the latency objective is complete
+func (s *sloConfig) validate() error {
+	if s.Availability < 0 || s.Availability >= 1 {
+		return errors.New("availability must be a fraction between 0 and 1, e.g. 0.999")
+	}
+	if s.LatencyRatio < 0 || s.LatencyRatio >= 1 {
+		return errors.New("latency_target must be a fraction between 0 and 1, e.g. 0.99")
+	}
+	if (s.LatencyRatio > 0) != (s.Latency > 0) {
+		return errors.New("latency and latency_target must be set together")
+	}
+	return nil
+}
+
+// recordSLO counts a request against the objectives of its route, the caller must hold the lock
+func (s *metricsShard) recordSLO(path string, statusCode int, elapsed time.Duration) {
+	route, rc := getConfig().matchRoute(path)
+	if rc == nil || rc.SLO == nil {
+		return
+	}
+
+	counters, ok := s.slo[route]
+	if !ok {
+		counters = &sloCounters{}
+		s.slo[route] = counters
+	}
+	counters.requests++
+	if statusCode >= http.StatusInternalServerError {
+		counters.errors++
+	}
+	if rc.SLO.Latency > 0 && elapsed > time.Duration(rc.SLO.Latency) {
+		counters.slow++
+	}
+}
+
+// writeSLOMetrics appends objectives and per-route totals in Prometheus format. Burn rates
+// follow as rate(slo_errors_total) / rate(slo_requests_total) / (1 - slo_target).
+func (m *Metrics) writeSLOMetrics(sb *strings.Builder) {
+	cfg := getConfig()
+	routes := make([]string, 0, len(cfg.Routes))
+	for route, rc := range cfg.Routes {
+		if rc.SLO != nil {
+			routes = append(routes, route)
+		}
+	}
+	if len(routes) == 0 {
+		return
+	}
+	sort.Strings(routes)
+	totals := m.sloTotals()
+
+	sb.WriteString("# HELP slo_target Objective of a route as the fraction of good requests\n")
+	sb.WriteString("# TYPE slo_target gauge\n")
+	for _, route := range routes {
+		slo := cfg.Routes[route].SLO
+		if slo.Availability > 0 {
+			sb.WriteString(fmt.Sprintf("slo_target{route=\"%s\",slo=\"availability\"} %g\n", route, slo.Availability))
+		}
+		if slo.LatencyRatio > 0 {
+			sb.WriteString(fmt.Sprintf("slo_target{route=\"%s\",slo=\"latency\"} %g\n", route, slo.LatencyRatio))
+		}
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP slo_latency_threshold_seconds Duration a request must complete within to meet the latency objective\n")
+	sb.WriteString("# TYPE slo_latency_threshold_seconds gauge\n")
+	for _, route := range routes {
+		if slo := cfg.Routes[route].SLO; slo.Latency > 0 {
+			sb.WriteString(fmt.Sprintf("slo_latency_threshold_seconds{route=\"%s\"} %g\n", route, time.Duration(slo.Latency).Seconds()))
+		}
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP slo_requests_total Requests counted against the objectives of a route\n")
+	sb.WriteString("# TYPE slo_requests_total counter\n")
+	for _, route := range routes {
+		sb.WriteString(fmt.Sprintf("slo_requests_total{route=\"%s\"} %d\n", route, totals[route].requests))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP slo_errors_total Requests that failed the availability objective of a route\n")
+	sb.WriteString("# TYPE slo_errors_total counter\n")
+	for _, route := range routes {
+		sb.WriteString(fmt.Sprintf("slo_errors_total{route=\"%s\"} %d\n", route, totals[route].errors))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP slo_slow_requests_total Requests that missed the latency objective of a route\n")
+	sb.WriteString("# TYPE slo_slow_requests_total counter\n")
+	for _, route := range routes {
+		sb.WriteString(fmt.Sprintf("slo_slow_requests_total{route=\"%s\"} %d\n", route, totals[route].slow))
+	}
+	sb.WriteString("\n")
+}
+
+// sloTotals merges the route totals of all shards
+func (m *Metrics) sloTotals() map[string]sloCounters {
+	totals := make(map[string]sloCounters)
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mutex.Lock()
+		for route, counters := range s.slo {
+			total := totals[route]
+			total.requests += counters.requests
+			total.errors += counters.errors
+			total.slow += counters.slow
+			totals[route] = total
+		}
+		s.mutex.Unlock()
+	}
+	return totals
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// How long to wait for dependencies at startup, 0 disables the gate
+	startupWaitTimeout time.Duration
+	// Extra dependencies to wait for, as URLs or TCP host:port addresses
+	startupDependencies []string
+	// Set once all dependencies have been reached
+	startupComplete atomic.Bool
+	// Reported by readiness until the startup gate has passed
+	errStartupPending = errors.New("waiting for dependencies to become available")
+)
+
+// Initialize startup gate settings from environment variables
+func init() {
+	startupWaitTimeout = getEnvDuration("STARTUP_WAIT_TIMEOUT", 0)
+	for _, entry := range strings.Split(lookupSetting("STARTUP_WAIT_DEPENDENCIES"), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			startupDependencies = append(startupDependencies, entry)
+		}
+	}
+	if startupWaitTimeout <= 0 {
+		startupComplete.Store(true)
+	}
+}
+
+// checkStartupDependency tries to reach a URL or TCP address once
+func checkStartupDependency(ctx context.Context, target string) error {
+	if strings.Contains(target, "://") {
+		return probeBackend(ctx, target, 5*time.Second)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// waitForDependencies retries every backend and declared dependency with backoff until all
+// answer, then opens readiness. The process exits if STARTUP_WAIT_TIMEOUT elapses first.
+func waitForDependencies() {
+	if startupComplete.Load() {
+		return
+	}
+
+	targets := slices.Concat(parseBackendURLs(backendURL), startupDependencies)
+	ctx, cancel := context.WithTimeout(context.Background(), startupWaitTimeout)
+	defer cancel()
+
+	log.Printf("Waiting up to %s for dependencies: %s", startupWaitTimeout, strings.Join(targets, ", "))
+	backoff := 500 * time.Millisecond
+	for {
+		pending := make(map[string]error)
+		for _, target := range targets {
+			if err := checkStartupDependency(ctx, target); err != nil {
+				pending[target] = err
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		log.Printf("Still waiting for %d dependencies, retrying in %s", len(pending), backoff)
+		select {
+		case <-ctx.Done():
+			for target, err := range pending {
+				log.Printf("Dependency %s unavailable: %v", target, err)
+			}
+			log.Fatalf("Dependencies not available after %s", startupWaitTimeout)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 10*time.Second)
+	}
+
+	startupComplete.Store(true)
+	log.Printf("All dependencies available, marking ready")
+}
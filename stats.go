@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	// Length of the sliding window summarized by /stats
+	statsWindow time.Duration
+	// Upper bound of requests kept for the window to cap memory use
+	statsMaxSamples int
+)
+
+// Initialize stats window settings from environment variables
+func init() {
+	statsWindow = getEnvDuration("STATS_WINDOW", 5*time.Minute)
+	statsMaxSamples = int(getEnvInt64("STATS_MAX_SAMPLES", 100000))
+}
+
+// requestSample is a single request kept for the sliding window
+type requestSample struct {
+	at       time.Time
+	path     string
+	method   string
+	status   int
+	duration time.Duration
+}
+
+// samplesPerShard returns each shard's share of the sample limit
+func (m *Metrics) samplesPerShard() int {
+	return max(statsMaxSamples/len(m.shards), 1)
+}
+
+// recordSample appends a request to the window and drops expired ones, the caller must hold the lock
+func (s *metricsShard) recordSample(sample requestSample, limit int) {
+	s.recent = append(s.recent, sample)
+	s.pruneSamples(sample.at, limit)
+}
+
+// pruneSamples drops requests older than the window or beyond the limit
+func (s *metricsShard) pruneSamples(now time.Time, limit int) {
+	cutoff := now.Add(-statsWindow)
+	drop := sort.Search(len(s.recent), func(i int) bool {
+		return s.recent[i].at.After(cutoff)
+	})
+	drop = max(drop, len(s.recent)-limit)
+	if drop > 0 {
+		// Reslicing keeps pruning cheap on the request path. Once the capacity left behind the
+		// window runs out, append moves it to a fresh array and the dropped prefix is released.
+		s.recent = s.recent[drop:]
+	}
+}
+
+// routeStats summarizes the requests to one path within the window
+type routeStats struct {
+	Path      string             `json:"path"`
+	Requests  int                `json:"requests"`
+	Errors    int                `json:"errors"`
+	ErrorRate float64            `json:"error_rate"`
+	LatencyMs map[string]float64 `json:"latency_ms"`
+	Methods   map[string]int     `json:"methods"`
+	Statuses  map[string]int     `json:"statuses"`
+}
+
+// statsSummary is the document returned by /stats
+type statsSummary struct {
+	Window string       `json:"window"`
+	Since  string       `json:"since"`
+	Routes []routeStats `json:"routes"`
+}
+
+// percentile returns the nearest-rank percentile of sorted durations in milliseconds
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
+
+// Stats summarizes requests per path over the sliding window.
+// Responses with a 5xx status count as errors.
+func (m *Metrics) Stats() statsSummary {
+	now := time.Now()
+	var samples []requestSample
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mutex.Lock()
+		s.pruneSamples(now, m.samplesPerShard())
+		samples = append(samples, s.recent...)
+		s.mutex.Unlock()
+	}
+
+	byPath := make(map[string]*routeStats)
+	latencies := make(map[string][]float64)
+	for _, sample := range samples {
+		rs, ok := byPath[sample.path]
+		if !ok {
+			rs = &routeStats{Path: sample.path, Methods: make(map[string]int), Statuses: make(map[string]int)}
+			byPath[sample.path] = rs
+		}
+		rs.Requests++
+		if sample.status >= http.StatusInternalServerError {
+			rs.Errors++
+		}
+		rs.Methods[sample.method]++
+		rs.Statuses[strconv.Itoa(sample.status)]++
+		latencies[sample.path] = append(latencies[sample.path], float64(sample.duration.Microseconds())/1000)
+	}
+
+	summary := statsSummary{
+		Window: statsWindow.String(),
+		Since:  now.Add(-statsWindow).UTC().Format(time.RFC3339),
+		Routes: make([]routeStats, 0, len(byPath)),
+	}
+	for path, rs := range byPath {
+		sorted := latencies[path]
+		sort.Float64s(sorted)
+		rs.ErrorRate = float64(rs.Errors) / float64(rs.Requests)
+		rs.LatencyMs = map[string]float64{
+			"p50": percentile(sorted, 50),
+			"p95": percentile(sorted, 95),
+			"p99": percentile(sorted, 99),
+		}
+		summary.Routes = append(summary.Routes, *rs)
+	}
+	sort.Slice(summary.Routes, func(i, j int) bool {
+		return summary.Routes[i].Path < summary.Routes[j].Path
+	})
+	return summary
+}
+
+// StatsHandler returns a JSON summary of requests, error rate and latency per path
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	// Only process requests for exact "/stats" path
+	if r.URL.Path != "/stats" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	writeIndentedResponse(w, r, http.StatusOK, metrics.Stats())
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Maximum proxied response body size in bytes, 0 means unlimited
+	responseMaxBytes int64
+	// Returned when a streamed response grows past responseMaxBytes
+	errResponseTooLarge = errors.New("response body exceeds RESPONSE_MAX_BYTES")
+	// How long the backend may go without sending body bytes, 0 disables the check. Set here
+	// rather than in init because the backend client is built before this file initializes.
+	streamIdleTimeout = getEnvDuration("STREAM_IDLE_TIMEOUT", 0)
+	// Number of backend responses aborted because they stopped making progress
+	streamStalls atomic.Int64
+)
+
+// Initialize response streaming settings from environment variables
+func init() {
+	responseMaxBytes = getEnvInt64("RESPONSE_MAX_BYTES", 0)
+}
+
+// streamResponseBody copies a backend response body to the client without buffering it.
+// When flush is set every chunk is pushed to the client as soon as it arrives.
+func streamResponseBody(w http.ResponseWriter, body io.Reader, flush bool) (int64, error) {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	var written int64
+
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			// Enforce the size cap on bodies without a trustworthy Content-Length
+			if responseMaxBytes > 0 && written+int64(n) > responseMaxBytes {
+				return written, errResponseTooLarge
+			}
+
+			m, err := w.Write(buf[:n])
+			written += int64(m)
+			if err != nil {
+				return written, err
+			}
+
+			if flush {
+				if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+					return written, err
+				}
+			}
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
+
+// streamStallError reports a backend that stopped sending its response body
+type streamStallError struct {
+	idle     time.Duration
+	received int64 // Body bytes received before the stall
+	expected int64 // Content-Length of the response, -1 when unknown
+}
+
+// Error describes how far the transfer got
+func (e *streamStallError) Error() string {
+	if e.expected >= 0 {
+		return fmt.Sprintf("backend sent no data for %s after %d of %d bytes", e.idle, e.received, e.expected)
+	}
+	return fmt.Sprintf("backend sent no data for %s after %d bytes", e.idle, e.received)
+}
+
+// idleTimeoutBody closes a response body when a read waits longer than the idle timeout.
+// Only time spent waiting on the backend counts, a slow client does not trip it.
+type idleTimeoutBody struct {
+	body     io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	received int64
+	expected int64
+
+	// Guards the state shared with the timer, which may fire while a read returns
+	mutex    sync.Mutex
+	reading  bool      // A read is waiting on the backend
+	deadline time.Time // When the pending read stalls
+	stalled  bool
+}
+
+// newIdleTimeoutBody wraps the body of a response with the idle timeout
+func newIdleTimeoutBody(resp *http.Response, timeout time.Duration) *idleTimeoutBody {
+	b := &idleTimeoutBody{body: resp.Body, timeout: timeout, expected: resp.ContentLength}
+	b.timer = time.AfterFunc(timeout, b.expire)
+	b.timer.Stop()
+	return b
+}
+
+// expire closes the body when the pending read is past its deadline. A timer armed for an
+// earlier read can still fire once Stop has lost the race, it finds no read pending or a
+// deadline in the future and does nothing.
+func (b *idleTimeoutBody) expire() {
+	b.mutex.Lock()
+	if !b.reading || time.Now().Before(b.deadline) {
+		b.mutex.Unlock()
+		return
+	}
+	b.stalled = true
+	b.mutex.Unlock()
+	streamStalls.Add(1)
+	// Unblocks the pending read
+	b.body.Close()
+}
+
+// Read reads from the backend, failing with a streamStallError once it stalls. Data that
+// arrived as the timer fired is still returned, the stall is reported by the next read.
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.mutex.Lock()
+	if b.stalled {
+		b.mutex.Unlock()
+		return 0, b.stallError()
+	}
+	b.reading = true
+	b.deadline = time.Now().Add(b.timeout)
+	b.mutex.Unlock()
+	b.timer.Reset(b.timeout)
+
+	n, err := b.body.Read(p)
+
+	b.mutex.Lock()
+	b.reading = false
+	stalled := b.stalled
+	b.mutex.Unlock()
+	b.timer.Stop()
+	b.received += int64(n)
+	if stalled && n == 0 {
+		return 0, b.stallError()
+	}
+	if stalled && err != nil {
+		// The error comes from the body closed by the timer
+		err = nil
+	}
+	return n, err
+}
+
+// stallError describes the stall with the bytes received so far
+func (b *idleTimeoutBody) stallError() error {
+	return &streamStallError{idle: b.timeout, received: b.received, expected: b.expected}
+}
+
+// Close stops the timer and closes the backend body
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	return b.body.Close()
+}
+
+// streamIdleTransport applies the idle timeout to every backend response body, including
+// those buffered for the cache or coalesced requests
+type streamIdleTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+// newStreamIdleTransport wraps a transport with the idle timeout, or returns it as is when disabled
+func newStreamIdleTransport(next http.RoundTripper, timeout time.Duration) http.RoundTripper {
+	if timeout <= 0 {
+		return next
+	}
+	return &streamIdleTransport{next: next, timeout: timeout}
+}
+
+// RoundTrip sends the request and guards the response body
+func (t *streamIdleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	// Upgraded connections have no body to guard and must keep their writable body
+	if err != nil || resp.Body == nil || resp.Body == http.NoBody || resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp, err
+	}
+	resp.Body = newIdleTimeoutBody(resp, t.timeout)
+	return resp, nil
+}
+
+// writeStreamMetrics appends the stalled response counter in Prometheus format
+func writeStreamMetrics(sb *strings.Builder) {
+	if streamIdleTimeout <= 0 {
+		return
+	}
+	sb.WriteString("# HELP backend_stream_stalls_total Backend responses aborted after STREAM_IDLE_TIMEOUT without data\n")
+	sb.WriteString("# TYPE backend_stream_stalls_total counter\n")
+	sb.WriteString(fmt.Sprintf("backend_stream_stalls_total %d\n", streamStalls.Load()))
+	sb.WriteString("\n")
+}
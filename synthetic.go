@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Header carrying the probe name, it lets the backend tell synthetic requests apart
+	syntheticProbeHeader = "X-Synthetic-Probe"
+	// Header carrying the token of this process, which marks a request as one of its probes
+	syntheticProbeTokenHeader = "X-Synthetic-Probe-Token"
+)
+
+var (
+	// Probe names are used as metric labels
+	probeNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+	// Random token sent by the probes of this process. Neither the probe header nor a loopback
+	// peer is proof, behind a sidecar proxy every client connects from loopback.
+	syntheticProbeToken = newSyntheticProbeToken()
+)
+
+// newSyntheticProbeToken returns a random token for the probes of this process
+func newSyntheticProbeToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		log.Fatalf("Failed to generate the synthetic probe token: %v", err)
+	}
+	return hex.EncodeToString(token)
+}
+
+// probeConfig is an entry of the "probes" section of CONFIG_FILE, keyed by probe name. Probes
+// are sent to the instance itself, so they take the full proxy path a client request would.
+type probeConfig struct {
+	Method       string            `json:"method"`        // Defaults to GET
+	Path         string            `json:"path"`          // Path and optional query, e.g. "/?q=health"
+	Host         string            `json:"host"`          // Host header, the listener address when empty
+	Headers      map[string]string `json:"headers"`       // Extra request headers
+	Body         string            `json:"body"`          // Request body
+	Interval     duration          `json:"interval"`      // Time between runs, 30s by default
+	Timeout      duration          `json:"timeout"`       // Time allowed per run, 5s by default
+	ExpectStatus []int             `json:"expect_status"` // Accepted status codes, any below 400 when empty
+	ExpectBody   string            `json:"expect_body"`   // Text the response body must contain
+}
+
+// interval returns the time between runs
+func (pc *probeConfig) interval() time.Duration {
+	if pc.Interval <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(pc.Interval)
+}
+
+// timeout returns the time allowed per run
+func (pc *probeConfig) timeout() time.Duration {
+	if pc.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(pc.Timeout)
+}
+
+// validate checks the request and that runs of a probe cannot overlap
+func (pc *probeConfig) validate() error {
+	if !strings.HasPrefix(pc.Path, "/") {
+		return fmt.Errorf("path %q must start with /", pc.Path)
+	}
+	if pc.Interval != 0 && time.Duration(pc.Interval) < time.Second {
+		return errors.New("interval must be at least 1s")
+	}
+	if pc.timeout() > pc.interval() {
+		return fmt.Errorf("timeout %s exceeds the interval %s", pc.timeout(), pc.interval())
+	}
+	for _, status := range pc.ExpectStatus {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("expect_status: %d is not an HTTP status code", status)
+		}
+	}
+	return nil
+}
+
+// check verifies a response against the expectations of the probe
+func (pc *probeConfig) check(status int, body []byte) error {
+	if len(pc.ExpectStatus) > 0 && !slices.Contains(pc.ExpectStatus, status) {
+		return fmt.Errorf("status %d, expected one of %v", status, pc.ExpectStatus)
+	}
+	if len(pc.ExpectStatus) == 0 && status >= http.StatusBadRequest {
+		return fmt.Errorf("status %d", status)
+	}
+	if pc.ExpectBody != "" && !strings.Contains(string(body), pc.ExpectBody) {
+		return fmt.Errorf("body does not contain %q", pc.ExpectBody)
+	}
+	return nil
+}
+
+// isSyntheticProbe reports whether a request is a probe sent by this instance
+func isSyntheticProbe(r *http.Request) bool {
+	token := r.Header.Get(syntheticProbeTokenHeader)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(syntheticProbeToken)) == 1
+}
+
+// probeResult holds the outcome of the runs of a probe
+type probeResult struct {
+	runs     int64
+	failures int64
+	success  bool
+	duration time.Duration // Duration of the last run
+	lastRun  time.Time
+}
+
+// Results of the configured probes by name
+var probeResults = struct {
+	mutex   sync.Mutex
+	results map[string]*probeResult
+}{results: make(map[string]*probeResult)}
+
+// startSyntheticProbes runs the configured probes against the first listener serving the
+// proxy. Probes are read from the active configuration, so reloads add and remove them.
+func startSyntheticProbes(specs []listenerConfig) {
+	target := specs[0]
+	for _, spec := range specs {
+		if spec.exposes("proxy") {
+			target = spec
+			break
+		}
+	}
+	baseURL := "http://" + localServerAddr(target.Address)
+	if target.TLS != nil {
+		baseURL = "https://" + localServerAddr(target.Address)
+	}
+
+	// A bare transport talks to the instance directly, the certificate is issued for the
+	// service name rather than loopback so it is not verified
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	go func() {
+		due := make(map[string]time.Time)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			probes := getConfig().Probes
+			for _, name := range sortedKeys(probes) {
+				if now.Before(due[name]) {
+					continue
+				}
+				pc := probes[name]
+				due[name] = now.Add(pc.interval())
+				go runProbe(client, baseURL, name, pc)
+			}
+
+			// Forget probes removed by a reload, including results of runs that were in flight
+			for name := range due {
+				if _, ok := probes[name]; !ok {
+					delete(due, name)
+				}
+			}
+			probeResults.mutex.Lock()
+			for name := range probeResults.results {
+				if _, ok := probes[name]; !ok {
+					delete(probeResults.results, name)
+				}
+			}
+			probeResults.mutex.Unlock()
+		}
+	}()
+}
+
+// runProbe sends one probe request and records its outcome, logging failures and recoveries
+func runProbe(client *http.Client, baseURL, name string, pc probeConfig) {
+	start := time.Now()
+	err := sendProbe(client, baseURL, name, pc)
+	elapsed := time.Since(start)
+
+	probeResults.mutex.Lock()
+	result, ok := probeResults.results[name]
+	if !ok {
+		result = &probeResult{success: true}
+		probeResults.results[name] = result
+	}
+	recovered := err == nil && !result.success
+	result.runs++
+	result.success = err == nil
+	result.duration = elapsed
+	result.lastRun = start
+	if err != nil {
+		result.failures++
+	}
+	probeResults.mutex.Unlock()
+
+	switch {
+	case err != nil:
+		log.Printf("Synthetic probe %s failed after %s: %v", name, elapsed.Round(time.Millisecond), err)
+	case recovered:
+		log.Printf("Synthetic probe %s succeeded again", name)
+	}
+}
+
+// sendProbe performs the request of a probe and checks the response
+func sendProbe(client *http.Client, baseURL, name string, pc probeConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pc.timeout())
+	defer cancel()
+
+	method := pc.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, baseURL+pc.Path, strings.NewReader(pc.Body))
+	if err != nil {
+		return err
+	}
+	for header, value := range pc.Headers {
+		req.Header.Set(header, value)
+	}
+	req.Header.Set(syntheticProbeHeader, name)
+	req.Header.Set(syntheticProbeTokenHeader, syntheticProbeToken)
+	if pc.Host != "" {
+		req.Host = pc.Host
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("reading body: %w", err)
+	}
+	return pc.check(resp.StatusCode, body)
+}
+
+// writeSyntheticProbeMetrics appends synthetic probe metrics in Prometheus format
+func writeSyntheticProbeMetrics(sb *strings.Builder) {
+	probeResults.mutex.Lock()
+	defer probeResults.mutex.Unlock()
+	if len(probeResults.results) == 0 {
+		return
+	}
+	names := sortedKeys(probeResults.results)
+
+	sb.WriteString("# HELP synthetic_probe_success Whether the last run of the probe succeeded\n")
+	sb.WriteString("# TYPE synthetic_probe_success gauge\n")
+	for _, name := range names {
+		success := 0
+		if probeResults.results[name].success {
+			success = 1
+		}
+		sb.WriteString(fmt.Sprintf("synthetic_probe_success{probe=\"%s\"} %d\n", name, success))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP synthetic_probe_duration_seconds Duration of the last run of the probe\n")
+	sb.WriteString("# TYPE synthetic_probe_duration_seconds gauge\n")
+	for _, name := range names {
+		sb.WriteString(fmt.Sprintf("synthetic_probe_duration_seconds{probe=\"%s\"} %g\n", name, probeResults.results[name].duration.Seconds()))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP synthetic_probe_last_run_timestamp_seconds Unix time of the last run of the probe\n")
+	sb.WriteString("# TYPE synthetic_probe_last_run_timestamp_seconds gauge\n")
+	for _, name := range names {
+		sb.WriteString(fmt.Sprintf("synthetic_probe_last_run_timestamp_seconds{probe=\"%s\"} %d\n", name, probeResults.results[name].lastRun.Unix()))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP synthetic_probe_runs_total Runs of the probe\n")
+	sb.WriteString("# TYPE synthetic_probe_runs_total counter\n")
+	for _, name := range names {
+		sb.WriteString(fmt.Sprintf("synthetic_probe_runs_total{probe=\"%s\"} %d\n", name, probeResults.results[name].runs))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP synthetic_probe_failures_total Failed runs of the probe\n")
+	sb.WriteString("# TYPE synthetic_probe_failures_total counter\n")
+	for _, name := range names {
+		sb.WriteString(fmt.Sprintf("synthetic_probe_failures_total{probe=\"%s\"} %d\n", name, probeResults.results[name].failures))
+	}
+	sb.WriteString("\n")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// How long abusive requests are held before they are answered, 0 disables the tarpit
+	tarpitDelay time.Duration
+	// Requests matching this pattern on their URI or User-Agent are held and then refused
+	tarpitDenyPattern *regexp.Regexp
+	// 429 responses within tarpitWindow after which a client's requests are held and refused
+	tarpitStrikes int64
+	// Period over which a client's 429 responses are counted
+	tarpitWindow time.Duration
+	// Maximum number of requests held at once, further abusive requests are refused at once
+	// so the tarpit never ties up more than this many connections
+	tarpitMaxHeld int64
+	// Requests currently held
+	tarpitHeld atomic.Int64
+	// Held requests by reason
+	tarpitRequests = struct {
+		mutex  sync.Mutex
+		counts map[string]int64
+	}{counts: make(map[string]int64)}
+	// Clients over the strike limit
+	tarpitOffenders = &strikeRegistry{clients: make(map[string]*strikeCount)}
+)
+
+// Initialize tarpit settings from environment variables
+func init() {
+	tarpitDelay = getEnvDuration("TARPIT_DELAY", 0)
+	tarpitStrikes = getEnvInt64("TARPIT_STRIKES", 10)
+	tarpitWindow = getEnvDuration("TARPIT_WINDOW", time.Minute)
+	tarpitMaxHeld = getEnvInt64("TARPIT_MAX_HELD", 100)
+
+	if pattern := lookupSetting("TARPIT_DENY_PATTERN"); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Printf("Invalid TARPIT_DENY_PATTERN=%q, denylist disabled: %v", pattern, err)
+			recordEnvError(fmt.Errorf("TARPIT_DENY_PATTERN=%q is not a valid regular expression: %w", pattern, err))
+		} else {
+			tarpitDenyPattern = re
+		}
+	}
+}
+
+// strikeCount counts the 429 responses of a client in the current window
+type strikeCount struct {
+	count       int64
+	windowStart time.Time
+}
+
+// strikeRegistry tracks 429 responses per client and forgets quiet ones
+type strikeRegistry struct {
+	mutex     sync.Mutex
+	clients   map[string]*strikeCount
+	lastSweep time.Time
+}
+
+// strike counts a 429 response for a client
+func (reg *strikeRegistry) strike(client string) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	now := time.Now()
+	// Drop clients whose window has ended
+	if now.Sub(reg.lastSweep) > tarpitWindow {
+		for key, sc := range reg.clients {
+			if now.Sub(sc.windowStart) > tarpitWindow {
+				delete(reg.clients, key)
+			}
+		}
+		reg.lastSweep = now
+	}
+
+	sc, ok := reg.clients[client]
+	if !ok || now.Sub(sc.windowStart) > tarpitWindow {
+		sc = &strikeCount{windowStart: now}
+		reg.clients[client] = sc
+	}
+	sc.count++
+}
+
+// offending reports whether a client reached the strike limit in its current window
+func (reg *strikeRegistry) offending(client string) bool {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	sc, ok := reg.clients[client]
+	return ok && sc.count >= tarpitStrikes && time.Since(sc.windowStart) <= tarpitWindow
+}
+
+// count returns the number of clients currently over the strike limit
+func (reg *strikeRegistry) count() int {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	offenders := 0
+	for _, sc := range reg.clients {
+		if sc.count >= tarpitStrikes && time.Since(sc.windowStart) <= tarpitWindow {
+			offenders++
+		}
+	}
+	return offenders
+}
+
+// tarpitDenied reports whether a request matches TARPIT_DENY_PATTERN
+func tarpitDenied(r *http.Request) bool {
+	return tarpitDenyPattern != nil &&
+		(tarpitDenyPattern.MatchString(r.URL.RequestURI()) || tarpitDenyPattern.MatchString(r.UserAgent()))
+}
+
+// TarpitMiddleware holds requests from abusive clients for TARPIT_DELAY before refusing them,
+// raising the cost of scraping and brute forcing. Requests matching TARPIT_DENY_PATTERN get a
+// 403, clients that received TARPIT_STRIKES 429 responses within TARPIT_WINDOW get a 429
+// without reaching the backend until the window ends.
+func TarpitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Failing probes would otherwise collect strikes and get the instance itself tarpitted
+		if tarpitDelay <= 0 || isSyntheticProbe(r) {
+			next(w, r)
+			return
+		}
+
+		client := clientIP(r)
+		switch {
+		case tarpitDenied(r):
+			tarpit(w, r, "denylist", http.StatusForbidden, "Forbidden")
+		case tarpitOffenders.offending(client):
+			tarpit(w, r, "rate_limit", http.StatusTooManyRequests, "Too many requests")
+		default:
+			rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			next(rw, r)
+			if rw.statusCode == http.StatusTooManyRequests {
+				tarpitOffenders.strike(client)
+			}
+		}
+	}
+}
+
+// tarpit holds a request for TARPIT_DELAY, unless too many are held already, then refuses it
+// and closes the connection so the client has to connect again
+func tarpit(w http.ResponseWriter, r *http.Request, reason string, status int, msg string) {
+	tarpitRequests.mutex.Lock()
+	tarpitRequests.counts[reason]++
+	tarpitRequests.mutex.Unlock()
+
+	if tarpitHeld.Add(1) <= tarpitMaxHeld {
+		timer := time.NewTimer(tarpitDelay)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+		}
+	}
+	tarpitHeld.Add(-1)
+
+	w.Header().Set("Connection", "close")
+	writeError(w, r, status, msg)
+}
+
+// writeTarpitMetrics appends tarpit metrics in Prometheus format
+func writeTarpitMetrics(sb *strings.Builder) {
+	if tarpitDelay <= 0 {
+		return
+	}
+	sb.WriteString("# HELP tarpit_held_requests Abusive requests currently held\n")
+	sb.WriteString("# TYPE tarpit_held_requests gauge\n")
+	sb.WriteString(fmt.Sprintf("tarpit_held_requests %d\n", tarpitHeld.Load()))
+	sb.WriteString("\n")
+
+	sb.WriteString("# HELP tarpit_offending_clients Clients over the TARPIT_STRIKES limit\n")
+	sb.WriteString("# TYPE tarpit_offending_clients gauge\n")
+	sb.WriteString(fmt.Sprintf("tarpit_offending_clients %d\n", tarpitOffenders.count()))
+	sb.WriteString("\n")
+
+	tarpitRequests.mutex.Lock()
+	defer tarpitRequests.mutex.Unlock()
+	sb.WriteString("# HELP tarpit_requests_total Requests held and refused by the tarpit\n")
+	sb.WriteString("# TYPE tarpit_requests_total counter\n")
+	for _, reason := range []string{"denylist", "rate_limit"} {
+		sb.WriteString(fmt.Sprintf("tarpit_requests_total{reason=\"%s\"} %d\n", reason, tarpitRequests.counts[reason]))
+	}
+	sb.WriteString("\n")
+}
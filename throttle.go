@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// Egress bandwidth limit for proxied responses in bytes per second, 0 disables throttling
+	throttleBytesPerSec int64
+	// Whether the limit applies per "connection" or per "client" IP
+	throttleScope string
+	// Token buckets shared by all connections of a client IP
+	clientLimiters = &limiterRegistry{limiters: make(map[string]*bandwidthLimiter)}
+)
+
+// throttleContextKey is the connection context key holding a per-connection limiter
+type throttleContextKey struct{}
+
+// Initialize bandwidth throttling settings from environment variables
+func init() {
+	throttleBytesPerSec = getEnvInt64("THROTTLE_BYTES_PER_SEC", 0)
+	throttleScope = getEnv("THROTTLE_SCOPE", "client")
+	if throttleScope != "client" && throttleScope != "connection" {
+		log.Printf("Unsupported THROTTLE_SCOPE=%q, using client", throttleScope)
+		recordEnvError(fmt.Errorf("THROTTLE_SCOPE=%q must be client or connection", throttleScope))
+		throttleScope = "client"
+	}
+}
+
+// bandwidthLimiter is a token bucket measured in bytes
+type bandwidthLimiter struct {
+	mutex    sync.Mutex
+	rate     float64 // Bytes added per second
+	tokens   float64 // Bytes currently available
+	last     time.Time
+	lastUsed time.Time
+}
+
+// newBandwidthLimiter creates a limiter allowing a one second burst
+func newBandwidthLimiter(bytesPerSec int64) *bandwidthLimiter {
+	now := time.Now()
+	return &bandwidthLimiter{
+		rate:     float64(bytesPerSec),
+		tokens:   float64(bytesPerSec),
+		last:     now,
+		lastUsed: now,
+	}
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller must wait
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.lastUsed = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// limiterRegistry holds per-client limiters and forgets idle ones
+type limiterRegistry struct {
+	mutex     sync.Mutex
+	limiters  map[string]*bandwidthLimiter
+	lastSweep time.Time
+}
+
+// get returns the limiter for a client, creating it on first use
+func (reg *limiterRegistry) get(client string) *bandwidthLimiter {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	// Drop limiters of clients that have been idle for a while
+	if time.Since(reg.lastSweep) > time.Minute {
+		for key, limiter := range reg.limiters {
+			limiter.mutex.Lock()
+			idle := time.Since(limiter.lastUsed) > time.Minute
+			limiter.mutex.Unlock()
+			if idle {
+				delete(reg.limiters, key)
+			}
+		}
+		reg.lastSweep = time.Now()
+	}
+
+	limiter, ok := reg.limiters[client]
+	if !ok {
+		limiter = newBandwidthLimiter(throttleBytesPerSec)
+		reg.limiters[client] = limiter
+	}
+	return limiter
+}
+
+// ThrottleConnContext attaches a bandwidth limiter to each new connection
+func ThrottleConnContext(ctx context.Context, c net.Conn) context.Context {
+	if throttleBytesPerSec > 0 && throttleScope == "connection" {
+		return context.WithValue(ctx, throttleContextKey{}, newBandwidthLimiter(throttleBytesPerSec))
+	}
+	return ctx
+}
+
+// ThrottleMiddleware shapes the response bandwidth of the wrapped handler
+func ThrottleMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if throttleBytesPerSec <= 0 {
+			next(w, r)
+			return
+		}
+
+		var limiter *bandwidthLimiter
+		if throttleScope == "connection" {
+			limiter, _ = r.Context().Value(throttleContextKey{}).(*bandwidthLimiter)
+		} else {
+			limiter = clientLimiters.get(clientIP(r))
+		}
+		if limiter == nil {
+			next(w, r)
+			return
+		}
+
+		next(&throttledWriter{ResponseWriter: w, limiter: limiter, ctx: r.Context()}, r)
+	}
+}
+
+// throttledWriter delays writes to stay within the limiter's rate
+type throttledWriter struct {
+	http.ResponseWriter
+	limiter *bandwidthLimiter
+	ctx     context.Context
+}
+
+// Write sends the payload in slices no larger than the limiter's burst
+func (tw *throttledWriter) Write(b []byte) (int, error) {
+	chunk := max(int(tw.limiter.rate/10), 1)
+	written := 0
+	for written < len(b) {
+		end := min(written+chunk, len(b))
+		if delay := tw.limiter.reserve(end - written); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-tw.ctx.Done():
+				timer.Stop()
+				return written, tw.ctx.Err()
+			}
+		}
+
+		n, err := tw.ResponseWriter.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// clientIP returns the IP address of the directly connected client
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
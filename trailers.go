@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// announceTrailers declares the backend's trailers before the response header is written
+// and returns the announced keys
+func announceTrailers(w http.ResponseWriter, resp *http.Response) map[string]bool {
+	announced := make(map[string]bool, len(resp.Trailer))
+	if len(resp.Trailer) == 0 {
+		return announced
+	}
+	keys := make([]string, 0, len(resp.Trailer))
+	for key := range resp.Trailer {
+		keys = append(keys, key)
+		announced[key] = true
+	}
+	w.Header().Add("Trailer", strings.Join(keys, ", "))
+	return announced
+}
+
+// copyTrailers sends the backend's trailer values once the body has been copied.
+// Trailers the backend did not announce up front are sent using http.TrailerPrefix.
+func copyTrailers(w http.ResponseWriter, resp *http.Response, announced map[string]bool) {
+	for key, values := range resp.Trailer {
+		if !announced[key] {
+			key = http.TrailerPrefix + key
+		}
+		w.Header()[key] = values
+	}
+}
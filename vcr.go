@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+var (
+	// VCR mode: "record" persists backend exchanges, "replay" serves them without the backend
+	vcrMode string
+	// Directory holding recorded exchanges
+	vcrDir string
+	// Largest request or response body recorded, exchanges are held in memory until saved
+	vcrMaxBodyBytes int64
+)
+
+// errCassetteBodyTooLarge marks a request body over VCR_MAX_BODY_BYTES
+var errCassetteBodyTooLarge = errors.New("request body exceeds VCR_MAX_BODY_BYTES")
+
+// Initialize record-and-replay settings from environment variables
+func init() {
+	vcrMode = lookupSetting("VCR_MODE")
+	if vcrMode != "" && vcrMode != "record" && vcrMode != "replay" {
+		log.Printf("Unsupported VCR_MODE=%q, record and replay disabled", vcrMode)
+		recordEnvError(fmt.Errorf("VCR_MODE=%q must be record or replay", vcrMode))
+		vcrMode = ""
+	}
+	vcrDir = getEnv("VCR_DIR", "cassettes")
+	vcrMaxBodyBytes = getEnvInt64("VCR_MAX_BODY_BYTES", 10<<20)
+	if vcrMaxBodyBytes <= 0 {
+		log.Printf("Invalid VCR_MAX_BODY_BYTES=%d, using %d", vcrMaxBodyBytes, 10<<20)
+		recordEnvError(fmt.Errorf("VCR_MAX_BODY_BYTES=%d must be positive", vcrMaxBodyBytes))
+		vcrMaxBodyBytes = 10 << 20
+	}
+
+	if vcrMode != "" {
+		registerDependencyCheck("disk:"+vcrDir, func(ctx context.Context) error {
+			return checkDirWritable(vcrDir)
+		})
+	}
+}
+
+// cassette is a recorded backend exchange stored as JSON
+type cassette struct {
+	Method     string      `json:"method"`
+	URI        string      `json:"uri"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+
+	path string
+	buf  cappedBuffer
+}
+
+// cappedBuffer keeps up to VCR_MAX_BODY_BYTES of what is written and notes any overflow. It
+// never fails a write, so the response it tees is still streamed in full.
+type cappedBuffer struct {
+	bytes.Buffer
+	overflow bool
+}
+
+// Write keeps p unless it would exceed the cap
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.overflow || int64(b.Len()+len(p)) > vcrMaxBodyBytes {
+		b.overflow = true
+		b.Reset()
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// newCassette keys a request by method, URI and body, restoring the body for forwarding
+func newCassette(r *http.Request) (*cassette, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, vcrMaxBodyBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading request body: %w", err)
+	}
+	if int64(len(body)) > vcrMaxBodyBytes {
+		return nil, errCassetteBodyTooLarge
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", r.Method, r.URL.RequestURI())
+	h.Write(body)
+
+	return &cassette{
+		Method: r.Method,
+		URI:    r.URL.RequestURI(),
+		path:   filepath.Join(vcrDir, hex.EncodeToString(h.Sum(nil))+".json"),
+	}, nil
+}
+
+// capture records the backend response status and headers and tees its body
+func (c *cassette) capture(resp *http.Response, body io.Reader) io.Reader {
+	c.StatusCode = resp.StatusCode
+	c.Header = resp.Header.Clone()
+	return io.TeeReader(body, &c.buf)
+}
+
+// save writes the recorded exchange to disk, responses over VCR_MAX_BODY_BYTES are not recorded
+func (c *cassette) save() error {
+	if c.buf.overflow {
+		return fmt.Errorf("response body of %s %s exceeds VCR_MAX_BODY_BYTES", c.Method, c.URI)
+	}
+	c.Body = c.buf.Bytes()
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(vcrDir, 0o755); err != nil {
+		return err
+	}
+	// Write atomically so concurrent replays never see a partial file. Each save gets its own
+	// temporary file, concurrent recordings of the same exchange would otherwise mix their writes.
+	f, err := os.CreateTemp(filepath.Dir(c.path), ".cassette-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path)
+}
+
+// replayRecordedResponse serves a previously recorded exchange without contacting the backend
+func replayRecordedResponse(w http.ResponseWriter, r *http.Request) {
+	key, err := newCassette(r)
+	if errors.Is(err, errCassetteBodyTooLarge) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "Request body exceeds VCR_MAX_BODY_BYTES")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Error reading request: %v", err))
+		return
+	}
+
+	data, err := os.ReadFile(key.path)
+	if err != nil {
+		log.Printf("No recorded response for %s %s (%s)", r.Method, r.URL.RequestURI(), filepath.Base(key.path))
+		writeError(w, r, http.StatusBadGateway, "No recorded response for this request")
+		return
+	}
+	var recorded cassette
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		writeError(w, r, http.StatusInternalServerError, fmt.Sprintf("Error reading recorded response: %v", err))
+		return
+	}
+
+	for name, values := range recorded.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(recorded.Body)))
+	w.Header().Set("X-VCR", "replay")
+	w.WriteHeader(recorded.StatusCode)
+	w.Write(recorded.Body)
+}
+
+// checkDirWritable verifies a file can be created in a directory
+func checkDirWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}